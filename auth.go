@@ -2,21 +2,35 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// SessionCookieName is the cookie that carries the session JWT for browser clients.
+const SessionCookieName = "mchat_session"
+
 type User struct {
 	Token    string `json:"token"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
 	Id       int    `json:"id"`
 }
 
+// User roles. Moderators can edit and delete anyone's messages.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+)
+
 // HashPassword generates a bcrypt hash for the given password.
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
@@ -34,16 +48,25 @@ func VerifyPassword(password, hash string) bool {
 
 type AuthClaims struct {
 	Username string
-	Password string
+	Role     string
 	jwt.RegisteredClaims
 }
 
+// checkJWTSecret refuses to serve without JWT_SECRET: tokens signed with an
+// empty key could be forged by anyone, as any user.
+func checkJWTSecret() error {
+	if os.Getenv("JWT_SECRET") == "" {
+		return fmt.Errorf("JWT_SECRET must be set to sign session tokens")
+	}
+	return nil
+}
+
 func CreateJWT(usr *User) (string, error) {
 	secret := os.Getenv("JWT_SECRET")
 	// Create JWT
 	claims := &AuthClaims{
 		Username: usr.Username,
-		Password: usr.Password,
+		Role:     usr.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -66,3 +89,53 @@ func ValidateJWT(tokenString string) (*jwt.Token, error) {
 		return []byte(secret), nil
 	})
 }
+
+// ClaimsFromToken validates tokenString and returns its AuthClaims.
+func ClaimsFromToken(tokenString string) (*AuthClaims, error) {
+	token, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*AuthClaims)
+	if !ok || !token.Valid || claims.Username == "" {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+	return claims, nil
+}
+
+// TokenFromRequest extracts a JWT from the session cookie, an "Authorization: Bearer" header
+// or the Sec-WebSocket-Protocol header, in that order. Browsers can't set headers on a
+// websocket upgrade, so API clients may pass the token as a subprotocol instead; in that
+// case protocol is set so the upgrade can echo it back.
+func TokenFromRequest(r *http.Request) (token, protocol string) {
+	if cookie, err := r.Cookie(SessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, ""
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), ""
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		// JWTs are three dot-separated segments.
+		if strings.Count(p, ".") == 2 {
+			return p, p
+		}
+	}
+	return "", ""
+}
+
+// runRole implements `mchat role <username> <user|moderator>`. The new role
+// takes effect the next time each of the user's clients connects.
+func runRole(store Storage, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: mchat role <username> <%s|%s>", RoleUser, RoleModerator)
+	}
+	username, role := args[0], args[1]
+	if role != RoleUser && role != RoleModerator {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	if err := store.SetUserRole(username, role); err != nil {
+		return err
+	}
+	log.Printf("%s is now a %s", username, role)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// Broker carries events between mchat servers, so clients connected to
+// different replicas share rooms, presence and direct messages. Each server's
+// ClientManager publishes what happens to its own clients and applies what the
+// others publish.
+type Broker interface {
+	// Publish sends event to the other servers.
+	Publish(event *Event) error
+	// Events delivers the events other servers publish. It may also deliver
+	// this server's own, which carry its Origin.
+	Events() <-chan *Event
+	// Close stops delivering events and releases the broker.
+	Close() error
+}
+
+// NewBroker opens the Broker selected by the BROKER environment variable:
+// "local" (the default) for a single server, or "postgres" to share chats
+// between servers through the Postgres database in DB_CONN_STR.
+func NewBroker() (Broker, error) {
+	switch broker := os.Getenv("BROKER"); broker {
+	case "", "local":
+		return NewLocalBroker(), nil
+	case "postgres":
+		return NewPostgresBroker(os.Getenv("DB_CONN_STR"))
+	default:
+		return nil, fmt.Errorf("unknown BROKER %q", broker)
+	}
+}
+
+// Event kinds.
+const (
+	// EventMessage is a new chat message or reply, in Message.
+	EventMessage = "message"
+	// EventUpdate is Message after an edit, deletion or reaction; Update says which.
+	EventUpdate = "update"
+	// EventReplies says the thread under message ID got a reply.
+	EventReplies = "replies"
+	// EventPresence lists the users connected to the Origin server in each
+	// room. Servers send one whenever it changes and every presenceInterval
+	// regardless; an empty one means the server is shutting down.
+	EventPresence = "presence"
+	// EventAnnounce is a system message, Payload, for everyone in Room.
+	EventAnnounce = "announce"
+	// EventTyping says Username started typing in Room, or stopped if Typing is false.
+	EventTyping = "typing"
+	// EventRead says Username read Conversation from message From up to message ID.
+	EventRead = "read"
+)
+
+// Event is something that happened on one server that the others need to know.
+// Which fields are set depends on Kind.
+type Event struct {
+	// Origin identifies the server that published the event.
+	Origin       string                          `json:"origin"`
+	Kind         string                          `json:"kind"`
+	Message      *templates.Message              `json:"message,omitempty"`
+	Update       string                          `json:"update,omitempty"`
+	ID           int                             `json:"id,omitempty"`
+	From         int                             `json:"from,omitempty"`
+	Room         string                          `json:"room,omitempty"`
+	Conversation string                          `json:"conversation,omitempty"`
+	Username     string                          `json:"username,omitempty"`
+	Payload      string                          `json:"payload,omitempty"`
+	Typing       bool                            `json:"typing,omitempty"`
+	Presence     map[string][]templates.Presence `json:"presence,omitempty"`
+}
+
+// LocalBroker is an in-process Broker. On its own it connects nothing, which
+// is all a single server needs; Attach links more managers in the same process.
+type LocalBroker struct {
+	hub    *localHub
+	events chan *Event
+}
+
+// localHub is the set of LocalBrokers that hear each other.
+type localHub struct {
+	mu      sync.Mutex
+	brokers []*LocalBroker
+}
+
+func NewLocalBroker() *LocalBroker {
+	return (&localHub{}).attach()
+}
+
+// Attach returns a new LocalBroker that shares events with b and every other
+// broker attached to it.
+func (b *LocalBroker) Attach() *LocalBroker {
+	return b.hub.attach()
+}
+
+func (h *localHub) attach() *LocalBroker {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := &LocalBroker{hub: h, events: make(chan *Event, 256)}
+	h.brokers = append(h.brokers, b)
+	return b
+}
+
+// Publish hands event to every other attached broker. A broker whose manager
+// has fallen too far behind misses it.
+func (b *LocalBroker) Publish(event *Event) error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	for _, other := range b.hub.brokers {
+		if other == b {
+			continue
+		}
+		select {
+		case other.events <- event:
+		default:
+			metrics.Add("broker_dropped", 1)
+		}
+	}
+	return nil
+}
+
+func (b *LocalBroker) Events() <-chan *Event {
+	return b.events
+}
+
+func (b *LocalBroker) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	for i, other := range b.hub.brokers {
+		if other == b {
+			b.hub.brokers = append(b.hub.brokers[:i], b.hub.brokers[i+1:]...)
+			close(b.events)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLocalBrokerFanOut(t *testing.T) {
+	tests := []struct {
+		name string
+		// brokers is how many are attached, publisher which one publishes
+		// and closed which have been closed first.
+		brokers   int
+		publisher int
+		closed    []int
+		want      []int
+	}{
+		{name: "on its own", brokers: 1, publisher: 0, want: []int{}},
+		{name: "to every other broker", brokers: 3, publisher: 1, want: []int{0, 2}},
+		{name: "skips closed brokers", brokers: 3, publisher: 0, closed: []int{1}, want: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brokers := []*LocalBroker{NewLocalBroker()}
+			for len(brokers) < tt.brokers {
+				brokers = append(brokers, brokers[0].Attach())
+			}
+			for _, i := range tt.closed {
+				brokers[i].Close()
+			}
+			event := &Event{Origin: "a", Kind: EventAnnounce, Room: "lobby", Payload: "hi"}
+			if err := brokers[tt.publisher].Publish(event); err != nil {
+				t.Fatal(err)
+			}
+			got := []int{}
+			for i, b := range brokers {
+				if slices.Contains(tt.closed, i) {
+					continue
+				}
+				select {
+				case ev := <-b.Events():
+					if ev != event {
+						t.Errorf("broker %d got %+v, want %+v", i, ev, event)
+					}
+					got = append(got, i)
+				default:
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("delivered to brokers %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalBrokerCloseEndsEvents(t *testing.T) {
+	b := NewLocalBroker()
+	other := b.Attach()
+	other.Close()
+	if _, ok := <-other.Events(); ok {
+		t.Errorf("a closed broker still delivers events")
+	}
+	if err := b.Publish(&Event{Kind: EventAnnounce}); err != nil {
+		t.Errorf("publishing after another broker closed: %s", err)
+	}
+}
@@ -8,137 +8,790 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/muhreeowki/mchat/protocol"
 	"github.com/muhreeowki/mchat/templates"
 )
 
 type Client struct {
 	id       string
 	username string
-	conn     *websocket.Conn
-	manager  *ClientManager
-	send     chan []byte
+	room     string
+	format   string
+	role     string
+	// active is when the client last sent anything, in Unix nanoseconds.
+	active atomic.Int64
+	// reaped is set once the connection has been given up on as dead.
+	reaped atomic.Bool
+	// thread is the id of the message whose thread the client has open, if any.
+	// It is owned by the manager goroutine.
+	thread int
+	// peer is set on clients opened from a direct message page; they only receive that conversation.
+	peer string
+	// since is the id of the last message a reconnecting client saw. missed is
+	// what it missed, loaded before it registers, when seen messages had been
+	// delivered here.
+	since  int
+	missed []*templates.Message
+	seen   int64
+	// unread is the user's unread counts, loaded before the client registers.
+	unread  map[string]int
+	conn    *websocket.Conn
+	manager *ClientManager
+	// out queues frames for the write goroutine, which closes written when it returns.
+	out     *outbox
+	written chan struct{}
+	// guest is set for anonymous sessions and holds the limits they are held to.
+	guest *GuestLimits
+	// ip is the address the client connected from, which guests are rate limited by.
+	ip      string
+	limiter *Limiter
 }
 
-func NewClient(usrname string, conn *websocket.Conn, manager *ClientManager) *Client {
-	return &Client{
+func NewClient(usrname, room string, conn *websocket.Conn, manager *ClientManager) *Client {
+	c := &Client{
 		id:       uuid.NewString(),
 		username: usrname,
+		room:     room,
+		format:   FormatHTML,
 		conn:     conn,
 		manager:  manager,
-		send:     make(chan []byte),
+		out:      newOutbox(manager.outbox),
+		written:  make(chan struct{}),
 	}
+	c.touch()
+	return c
+}
+
+// inboundMessage is what a client sends over the websocket. htmx forms set
+// Action while JSON clients send a protocol.Envelope and set Type; either way
+// an empty value is a chat message for the client's current room.
+type inboundMessage struct {
+	Action string `json:"action,omitempty"`
+	Type   string `json:"type,omitempty"`
+	// ID names the message to edit, delete, react to or open the thread of.
+	// Both htmx and envelopes send it as a string.
+	ID string `json:"id,omitempty"`
+	// Parent names the message a reply belongs to.
+	Parent string `json:"parent,omitempty"`
+	// Room is the room to join. Messages always go to the client's current room.
+	Room      string `json:"room,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+}
+
+func (in *inboundMessage) kind() string {
+	if in.Type != "" {
+		return in.Type
+	}
+	return in.Action
 }
 
 func (c *Client) read() error {
+	if c.guest != nil && c.guest.SessionLifetime > 0 {
+		timer := time.AfterFunc(c.guest.SessionLifetime, c.expire)
+		defer timer.Stop()
+	}
 	defer func() {
-		c.manager.unregisterClient <- c
+		c.manager.unregister(c)
 		c.conn.Close()
 	}()
+	c.keepAlive()
 	for {
 		_, msgBytes, err := c.conn.ReadMessage()
 		if err != nil {
-			c.manager.unregisterClient <- c
+			c.reap(err)
+			c.manager.unregister(c)
 			c.conn.Close()
 			return err
 		}
-		msg := &templates.Message{}
-		if err := json.NewDecoder(bytes.NewReader(msgBytes)).Decode(msg); err != nil {
+		c.extendDeadline()
+		c.touch()
+		in := &inboundMessage{}
+		if err := json.NewDecoder(bytes.NewReader(msgBytes)).Decode(in); err != nil {
 			return err
 		}
-		c.manager.broadcast <- msg
-		log.Printf("successfully read from connection (%s): %s", c.conn.RemoteAddr(), msg)
+		if !c.throttle(in) {
+			continue
+		}
+		switch {
+		case in.kind() == protocol.TypeJoin:
+			if err := c.join(in.Room); err != nil {
+				c.manager.notify(c, err.Error())
+			}
+		case in.kind() == protocol.TypeLeave:
+			c.leave()
+		case in.kind() == protocol.TypeEdit, in.kind() == protocol.TypeDelete:
+			if err := c.modify(in.kind(), in.ID, in.Payload); err != nil {
+				c.manager.notify(c, err.Error())
+			}
+		case in.kind() == protocol.TypeThread:
+			if err := c.openThread(in.ID); err != nil {
+				c.manager.notify(c, err.Error())
+			}
+		case in.kind() == protocol.TypeRead:
+			if err := c.markRead(in.ID); err != nil {
+				c.manager.notify(c, err.Error())
+			}
+		case in.kind() == protocol.TypeTyping:
+			send(c.manager, c.manager.typing, c)
+		case in.kind() == protocol.TypeReact:
+			if err := c.react(in.ID, in.Payload); err != nil {
+				c.manager.notify(c, err.Error())
+			}
+		case strings.HasPrefix(strings.TrimSpace(in.Payload), "/"):
+			c.runCommand(strings.TrimSpace(in.Payload))
+		default:
+			msg, err := c.newMessage(in)
+			if err == nil {
+				err = c.post(msg)
+			}
+			if err != nil {
+				c.manager.notify(c, err.Error())
+				continue
+			}
+			log.Printf("successfully read from connection (%s): %+v", c.conn.RemoteAddr(), msg)
+		}
+	}
+}
+
+// newMessage builds the chat message in asks the client to send. Only the
+// payload and recipient come from the client; everything else is worked out here.
+func (c *Client) newMessage(in *inboundMessage) (*templates.Message, error) {
+	payload := strings.TrimSpace(in.Payload)
+	if payload == "" {
+		return nil, fmt.Errorf("Messages can't be empty.")
+	}
+	msg := &templates.Message{
+		Sender:    c.username,
+		Recipient: in.Recipient,
+		Room:      c.room,
+		Payload:   payload,
+		Datetime:  time.Now(),
+	}
+	if c.peer != "" {
+		msg.Recipient = c.peer
+	}
+	if in.Parent != "" {
+		if err := c.inThread(msg, in.Parent); err != nil {
+			return nil, err
+		}
 	}
+	if msg.Recipient != "" {
+		// Direct messages don't belong to a room.
+		msg.Room = ""
+		if !c.manager.knowsUser(msg.Recipient) {
+			return nil, fmt.Errorf("There is no user called %s.", msg.Recipient)
+		}
+	}
+	if err := c.checkGuestLimits(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// post hands msg to the manager to be delivered and stored.
+func (c *Client) post(msg *templates.Message) error {
+	if err := c.manager.persist.reserve(msg); err != nil {
+		log.Printf("post message error: %s", err)
+		return fmt.Errorf("Failed to send the message. Try again in a moment.")
+	}
+	send(c.manager, c.manager.broadcast, &sentMessage{client: c, msg: msg})
+	return nil
+}
+
+// join moves the client into room, checking it is allowed in.
+func (c *Client) join(room string) error {
+	if !ValidRoomName(room) {
+		return fmt.Errorf("%q is not a valid room name.", room)
+	}
+	if c.guest != nil && !c.guest.CanJoin(room) {
+		return fmt.Errorf("Guests can't join #%s. Sign up to access every room.", room)
+	}
+	c.room = room
+	send(c.manager, c.manager.joinRoom, &roomRequest{client: c, room: c.room})
+	return nil
+}
+
+// leave sends the client back to the DefaultRoom.
+func (c *Client) leave() {
+	c.room = DefaultRoom
+	send(c.manager, c.manager.joinRoom, &roomRequest{client: c, room: c.room})
+}
+
+// modify edits or deletes one of the client's messages (or anyone's, for moderators)
+// and pushes the change to everyone who can see it.
+func (c *Client) modify(kind, idStr, payload string) error {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return fmt.Errorf("%q is not a message id.", idStr)
+	}
+	msg, err := c.manager.store.GetMessage(id)
+	if err != nil || msg.Deleted {
+		return fmt.Errorf("That message doesn't exist.")
+	}
+	if msg.Sender != c.username && c.Permission() < PermModerator {
+		return fmt.Errorf("You can only change your own messages.")
+	}
+	if kind == protocol.TypeDelete {
+		if err := c.manager.store.DeleteMessage(id); err != nil {
+			log.Printf("delete message error: %s", err)
+			return fmt.Errorf("Failed to delete the message.")
+		}
+		msg.Payload, msg.Deleted, msg.Reactions = "", true, nil
+	} else {
+		payload = strings.TrimSpace(payload)
+		if payload == "" {
+			return fmt.Errorf("Messages can't be empty; delete it instead.")
+		}
+		if err := c.checkGuestLimits(&templates.Message{Payload: payload}); err != nil {
+			return err
+		}
+		if err := c.manager.store.UpdateMessage(id, payload); err != nil {
+			log.Printf("update message error: %s", err)
+			return fmt.Errorf("Failed to edit the message.")
+		}
+		msg.Payload, msg.Edited = payload, true
+	}
+	send(c.manager, c.manager.updates, &messageUpdate{typ: kind, msg: msg})
+	return nil
+}
+
+// checkGuestLimits returns an error describing the limit msg breaks, if the client is a guest.
+func (c *Client) checkGuestLimits(msg *templates.Message) error {
+	if c.guest == nil {
+		return nil
+	}
+	if n := utf8.RuneCountInString(msg.Payload); n > c.guest.MaxMessageLength {
+		return fmt.Errorf("Guest messages are limited to %d characters (yours had %d).", c.guest.MaxMessageLength, n)
+	}
+	return nil
+}
+
+// expire ends a guest session once its lifetime is up.
+func (c *Client) expire() {
+	c.disconnect("Your guest session has expired. Sign up to keep chatting.", websocket.ClosePolicyViolation, "guest session expired")
+}
+
+// disconnect tells the client why with a system message, then closes the
+// connection with code and reason once everything queued for it, the message
+// included, has been written. It must not be called from the manager goroutine.
+func (c *Client) disconnect(why string, code int, reason string) {
+	f := notice(c, why)
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	c.manager.do(func() {
+		c.manager.deliver(c, f)
+		c.out.drain(closeMsg)
+	})
 }
 
 func (c *Client) write() error {
 	defer func() {
 		c.conn.Close()
+		close(c.written)
 	}()
-	for msg := range c.send {
+	for {
+		msg, ok := c.out.next()
+		if !ok {
+			if closeMsg, drained := c.out.drained(); drained {
+				return c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			}
+			return nil
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(c.manager.heartbeat.WriteTimeout))
 		err := c.conn.WriteMessage(websocket.TextMessage, msg)
 		if err != nil {
+			c.reap(err)
 			return fmt.Errorf("failed to write message from [%s]: %s", c.conn.RemoteAddr(), err)
 		}
 		log.Printf("successfully wrote to connection (%s): %s", c.conn.RemoteAddr(), msg)
 	}
-	return nil
 }
 
 type ClientManager struct {
-	clients          map[*Client]bool
-	broadcast        chan *templates.Message
+	// clients maps every registered client to the room it is currently in.
+	clients          map[*Client]*Room
+	rooms            map[string]*Room
+	broadcast        chan *sentMessage
+	updates          chan *messageUpdate
 	registerClient   chan *Client
 	unregisterClient chan *Client
+	joinRoom         chan *roomRequest
+	typing           chan *Client
+	reads            chan *readEvent
+	system           chan *systemMessage
+	exec             chan func()
+	commands         *CommandRegistry
 	store            Storage
-	logger           *log.Logger
+	// awayAfter is how long a user can be idle before showing as away, and
+	// wasAway whether each user showed as away at the last check.
+	awayAfter time.Duration
+	wasAway   map[string]bool
+	// typists holds when each user typing in a room stops showing as typing.
+	typists map[*Room]map[string]time.Time
+	// unread caches the unread counts of every connected user by conversation.
+	unread map[string]map[string]int
+	// outbox sizes each client's outbound queue.
+	outbox OutboxConfig
+	// heartbeat says how clients are pinged and when they are given up on.
+	heartbeat HeartbeatConfig
+	// replayLimit is the most missed messages replayed to a reconnecting client.
+	replayLimit int
+	// delivered counts the messages delivered here, and recent holds the latest.
+	delivered atomic.Int64
+	recent    []recentMessage
+	// persist stores broadcast messages in the background.
+	persist *persister
+	// id identifies this server to the others on broker. Events for them wait
+	// in outgoing, and forwarded is closed once the queue is closed and drained.
+	id        string
+	broker    Broker
+	outgoing  chan *Event
+	forwarded chan struct{}
+	// remote holds who is connected to each of the other servers.
+	remote map[string]*remoteServer
+	// quit stops the manager, and done is closed once it has stopped.
+	quit   chan struct{}
+	done   chan struct{}
+	logger *log.Logger
 }
 
-func NewClientManager(store Storage) *ClientManager {
-	return &ClientManager{
-		clients:          make(map[*Client]bool),
-		broadcast:        make(chan *templates.Message),
+func NewClientManager(store Storage, broker Broker) *ClientManager {
+	cfg := PersistConfigFromEnv()
+	if _, local := broker.(*LocalBroker); !local {
+		// Ids reserved ahead by one server would be older than those other
+		// servers hand out meanwhile, and history is paged by id.
+		cfg.ReserveEach = true
+	}
+	persist := newPersister(store, cfg)
+	manager := &ClientManager{
+		clients:          make(map[*Client]*Room),
+		rooms:            make(map[string]*Room),
+		broadcast:        make(chan *sentMessage),
+		updates:          make(chan *messageUpdate),
 		registerClient:   make(chan *Client),
 		unregisterClient: make(chan *Client),
-		store:            store,
+		joinRoom:         make(chan *roomRequest),
+		typing:           make(chan *Client),
+		reads:            make(chan *readEvent),
+		system:           make(chan *systemMessage),
+		exec:             make(chan func()),
+		commands:         DefaultCommands(),
+		store:            persistedStore{Storage: store, persist: persist},
+		awayAfter:        awayAfterFromEnv(),
+		wasAway:          make(map[string]bool),
+		typists:          make(map[*Room]map[string]time.Time),
+		unread:           make(map[string]map[string]int),
+		outbox:           OutboxConfigFromEnv(),
+		heartbeat:        HeartbeatConfigFromEnv(),
+		replayLimit:      replayLimitFromEnv(),
+		persist:          persist,
+		id:               uuid.NewString(),
+		broker:           broker,
+		outgoing:         make(chan *Event, outgoingQueueSize),
+		forwarded:        make(chan struct{}),
+		remote:           make(map[string]*remoteServer),
+		quit:             make(chan struct{}),
+		done:             make(chan struct{}),
 		logger:           log.New(os.Stdout, "[client-manager] ", log.LstdFlags),
 	}
+	manager.persist.stored = manager.stored
+	return manager
 }
 
 func (manager *ClientManager) Start() {
+	defer close(manager.done)
+	go manager.persist.run()
+	go manager.forward()
+	events := manager.broker.Events()
+	idle := time.NewTicker(min(presenceInterval, manager.awayAfter/2))
+	defer idle.Stop()
+	typing := time.NewTicker(typingInterval)
+	defer typing.Stop()
 	for {
 		select {
+		case <-manager.quit:
+			// Every client closes once what is queued for it has been written.
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+			for client := range manager.clients {
+				client.out.drain(closeMsg)
+			}
+			// An empty presence list tells the other servers this one is gone.
+			manager.publish(&Event{Kind: EventPresence})
+			return
+
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			manager.apply(event)
+
 		case client := <-manager.registerClient:
 			manager.logger.Printf("/Socket [%s] connected.", client.conn.RemoteAddr())
-			manager.clients[client] = true
-			// msg, _ := json.Marshal(&templates.Message{
-			// 	Payload: "A new socket connected.",
-			// })
-			// manager.Send(msg, client)
+			if client.room != "" {
+				manager.join(client, client.room)
+			} else {
+				manager.clients[client] = nil
+			}
+			if client.guest == nil {
+				manager.cacheUnread(client.username, client.unread)
+			}
+			if client.since > 0 {
+				manager.replay(client)
+			}
 
 		case client := <-manager.unregisterClient:
 			if _, ok := manager.clients[client]; ok {
 				manager.logger.Printf("/Socket [%s] disconnected.", client.conn.RemoteAddr())
-				close(client.send)
-				delete(manager.clients, client)
-				// msg, _ := json.Marshal(&templates.Message{
-				// 	Payload: "A socket disconnected.",
-				// })
-				// manager.Send(msg, client)
+				manager.remove(client)
 			}
 
-		case msg := <-manager.broadcast:
-			buf := new(bytes.Buffer)
-			templates.WsChatMessage(msg).Render(context.Background(), buf)
-			for client := range manager.clients {
-				select {
-				case client.send <- buf.Bytes():
-				default:
-					close(client.send)
-					delete(manager.clients, client)
+		case req := <-manager.joinRoom:
+			if _, ok := manager.clients[req.client]; ok {
+				manager.join(req.client, req.room)
+			}
+
+		case sys := <-manager.system:
+			if _, ok := manager.clients[sys.client]; ok {
+				manager.deliver(sys.client, sys.frame)
+			}
+
+		case fn := <-manager.exec:
+			fn()
+
+		case now := <-idle.C:
+			manager.checkIdle()
+			manager.expireRemotes(now)
+			// Doubles as the heartbeat that keeps this server on the others' online lists.
+			manager.sharePresence()
+
+		case client := <-manager.typing:
+			manager.startTyping(client)
+
+		case ev := <-manager.reads:
+			if _, ok := manager.clients[ev.client]; ok {
+				manager.markedRead(ev)
+				manager.publish(&Event{Kind: EventRead, Username: ev.username, Conversation: ev.conversation, From: ev.from, ID: ev.to})
+			}
+
+		case now := <-typing.C:
+			manager.expireTyping(now)
+
+		case sent := <-manager.broadcast:
+			// The message goes out with its id straight away and is stored in the background.
+			msg := sent.msg
+			if err := manager.persist.accept(msg); err != nil {
+				manager.logger.Printf("refused message from %s: %s", msg.Sender, err)
+				if _, ok := manager.clients[sent.client]; ok {
+					manager.deliver(sent.client, notice(sent.client, err.Error()))
 				}
+				continue
 			}
-			// Store the message
-			err := manager.store.StoreMessage(msg)
-			if err != nil {
-				manager.logger.Printf("error storing message: %s", err)
+			manager.deliverMessage(msg)
+			manager.logger.Printf("broadcasted message: %+v", msg)
+
+		case u := <-manager.updates:
+			manager.routeUpdate(u.typ, u.msg)
+			manager.publish(&Event{Kind: EventUpdate, Update: u.typ, Message: u.msg})
+		}
+	}
+}
+
+// deliverMessage sends a new message to the clients here that can see it.
+func (manager *ClientManager) deliverMessage(msg *templates.Message) {
+	typ := protocol.TypeMessage
+	if msg.Recipient != "" {
+		typ = protocol.TypeWhisper
+	}
+	if msg.ParentId != 0 {
+		manager.route(msg, newFrame(templates.WsThreadReply(msg), typ, msg))
+	} else {
+		manager.route(msg, newFrame(templates.WsChatMessage(msg), typ, msg))
+	}
+	if room, ok := manager.rooms[msg.Room]; ok && msg.Recipient == "" {
+		manager.stopTyping(room, msg.Sender)
+	}
+	manager.countUnread(msg)
+	manager.remember(msg)
+}
+
+// routeUpdate sends an edited, deleted or reacted to message to the clients here that can see it.
+func (manager *ClientManager) routeUpdate(typ string, msg *templates.Message) {
+	html := templates.WsMessageUpdate(msg)
+	if typ == protocol.TypeReact {
+		html = templates.WsReactions(msg)
+	}
+	f := newFrame(html, typ, msg)
+	f.key = typ + ":" + strconv.Itoa(msg.Id)
+	manager.route(msg, f)
+}
+
+// SystemSender is the Sender on messages generated by the server itself.
+const SystemSender = "system"
+
+// systemMessage is a frame from the server meant for a single client.
+type systemMessage struct {
+	client *Client
+	frame  *frame
+}
+
+// sentMessage is a new chat message and the client that sent it, which is told
+// if the message can't be sent.
+type sentMessage struct {
+	client *Client
+	msg    *templates.Message
+}
+
+// notice builds a system message for client.
+func notice(client *Client, payload string) *frame {
+	msg := &templates.Message{Sender: SystemSender, Recipient: client.username, Payload: payload, Datetime: time.Now()}
+	return newFrame(templates.WsSystemMessage(payload), protocol.TypeSystem, msg)
+}
+
+// notify queues a system message for client. It must not be called from the manager goroutine.
+func (manager *ClientManager) notify(client *Client, payload string) {
+	send(manager, manager.system, &systemMessage{client: client, frame: notice(client, payload)})
+}
+
+// send hands v to the manager goroutine on ch, unless the manager stops first,
+// and reports whether it was taken. Everything sent to the manager from other
+// goroutines goes through it, so nothing blocks forever once the manager is gone.
+func send[T any](manager *ClientManager, ch chan T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-manager.done:
+		return false
+	}
+}
+
+// later runs fn on the manager goroutine without waiting for it, unless the
+// manager stops first. It is safe to call from any goroutine.
+func (manager *ClientManager) later(fn func()) {
+	go send(manager, manager.exec, fn)
+}
+
+// Stop stops the manager and shuts everything it started down cleanly: each
+// client is sent what is queued for it and then closed, queued messages are
+// stored and queued events published. Whatever is left when ctx ends is abandoned.
+func (manager *ClientManager) Stop(ctx context.Context) error {
+	manager.quit <- struct{}{}
+	<-manager.done
+	// Nothing can queue messages now the manager has stopped, and once those
+	// queued are stored and shared, nothing can queue events either.
+	stored := make(chan error, 1)
+	go func() {
+		err := manager.persist.Close(ctx)
+		close(manager.outgoing)
+		stored <- err
+	}()
+	for client := range manager.clients {
+		select {
+		case <-client.written:
+		case <-ctx.Done():
+			client.conn.Close()
+		}
+	}
+	select {
+	case <-manager.forwarded:
+	case <-ctx.Done():
+	}
+	if err := manager.broker.Close(); err != nil {
+		manager.logger.Printf("error closing broker: %s", err)
+	}
+	return <-stored
+}
+
+// register hands client to the manager. It reports false if the manager has stopped.
+func (manager *ClientManager) register(client *Client) bool {
+	return send(manager, manager.registerClient, client)
+}
+
+// unregister tells the manager client has gone, unless the manager has stopped.
+func (manager *ClientManager) unregister(client *Client) {
+	send(manager, manager.unregisterClient, client)
+}
+
+// do runs fn on the manager goroutine and waits for it to finish, giving
+// callers safe access to rooms and clients. fn doesn't run if the manager has
+// stopped. It must not be called from the manager goroutine.
+func (manager *ClientManager) do(fn func()) {
+	done := make(chan struct{})
+	if send(manager, manager.exec, func() {
+		fn()
+		close(done)
+	}) {
+		<-done
+	}
+}
+
+// deliver encodes f in the client's wire format and queues it for that client.
+// It never blocks: a client that can't keep up is dealt with by the outbox's
+// overflow policy.
+func (manager *ClientManager) deliver(client *Client, f *frame) {
+	b, err := f.encode(client.format)
+	if err != nil {
+		manager.logger.Printf("error encoding frame: %s", err)
+		return
+	}
+	if !client.out.push(f.key, b) {
+		manager.logger.Printf("/Socket [%s] fell too far behind, disconnecting.", client.conn.RemoteAddr())
+		manager.remove(client)
+	}
+}
+
+// usernames lists the distinct usernames connected to room, or to any room if room is empty.
+func (manager *ClientManager) usernames(room string) []string {
+	names := []string{}
+	manager.do(func() {
+		for client, r := range manager.clients {
+			if (room == "" || (r != nil && r.name == room)) && !slices.Contains(names, client.username) {
+				names = append(names, client.username)
+			}
+		}
+		for _, p := range manager.remoteUsers(room) {
+			if !slices.Contains(names, p.Username) {
+				names = append(names, p.Username)
 			}
-			manager.logger.Printf("broadcasted message: %s", msg)
+		}
+	})
+	slices.Sort(names)
+	return names
+}
+
+// rename changes client's username unless another connected client already uses it.
+// The change happens on the manager goroutine so lookups by username never race with it.
+func (manager *ClientManager) rename(client *Client, name string) bool {
+	ok := false
+	manager.do(func() {
+		if manager.taken(name) {
+			return
+		}
+		ok = true
+		client.username = name
+		if room := manager.clients[client]; room != nil {
+			manager.publishPresence(room)
+			manager.sharePresence()
+		}
+	})
+	return ok
+}
+
+// guestName picks a guest name nobody connected here or to another server is
+// using. It runs before the guest registers, so the client's goroutines only
+// ever see the name it keeps.
+func (manager *ClientManager) guestName() string {
+	name := NewGuestName()
+	manager.do(func() {
+		for manager.taken(name) {
+			name = NewGuestName()
+		}
+	})
+	return name
+}
+
+// taken reports whether someone connected here or to another server is using name.
+func (manager *ClientManager) taken(name string) bool {
+	for client := range manager.clients {
+		if client.username == name {
+			return true
 		}
 	}
+	return slices.ContainsFunc(manager.remoteUsers(""), func(p templates.Presence) bool { return p.Username == name })
 }
 
-func (manager *ClientManager) Send(msg []byte, from *Client) {
+// route delivers f to everyone who can see msg: its room, or for direct messages
+// every client of the sender and recipient.
+func (manager *ClientManager) route(msg *templates.Message, f *frame) {
+	if msg.Recipient == "" {
+		if room, ok := manager.rooms[msg.Room]; ok {
+			for client := range room.clients {
+				// Replies only go to people with their thread open.
+				if msg.ParentId == 0 || client.thread == msg.ParentId {
+					manager.deliver(client, f)
+				}
+			}
+		}
+		return
+	}
 	for client := range manager.clients {
-		if client != from {
-			client.send <- msg
+		var partner string
+		switch client.username {
+		case msg.Recipient:
+			partner = msg.Sender
+		case msg.Sender:
+			partner = msg.Recipient
+		default:
+			continue
+		}
+		// Direct message pages only show their own conversation.
+		if client.peer == "" || client.peer == partner {
+			manager.deliver(client, f)
 		}
 	}
-	manager.logger.Printf("broadcasted message: %s", msg)
+}
+
+// knowsUser reports whether username is a registered user or someone connected right now.
+// It must not be called from the manager goroutine.
+func (manager *ClientManager) knowsUser(username string) bool {
+	if _, err := manager.store.GetUser(username); err == nil {
+		return true
+	}
+	return slices.Contains(manager.usernames(""), username)
+}
+
+// join moves a client out of its current room (if any) and into the named room,
+// creating the room on first use.
+func (manager *ClientManager) join(client *Client, name string) {
+	manager.leave(client)
+	room, ok := manager.rooms[name]
+	if !ok {
+		room = NewRoom(name)
+		manager.rooms[name] = room
+	}
+	room.clients[client] = true
+	manager.clients[client] = room
+	manager.logger.Printf("/Socket [%s] joined room %q.", client.conn.RemoteAddr(), name)
+	manager.arrived(room, client)
+}
+
+// leave takes a client out of its current room, dropping the room once it is empty.
+func (manager *ClientManager) leave(client *Client) {
+	room := manager.clients[client]
+	if room == nil {
+		return
+	}
+	delete(room.clients, client)
+	if room.Empty() {
+		delete(manager.rooms, room.name)
+	}
+	manager.clients[client] = nil
+	client.thread = 0
+	manager.stopTyping(room, client.username)
+	manager.publish(&Event{Kind: EventTyping, Room: room.name, Username: client.username})
+	manager.departed(room, client)
+}
+
+// remove unregisters a client entirely and closes its outbox.
+func (manager *ClientManager) remove(client *Client) {
+	manager.leave(client)
+	client.out.close()
+	delete(manager.clients, client)
+	if !manager.online(client.username) {
+		delete(manager.unread, client.username)
+	}
 }
 
 var upgrader = websocket.Upgrader{
@@ -150,13 +803,18 @@ type ClientServer struct {
 	listenAddr    string
 	store         Storage
 	clientManager *ClientManager
-	logger        *log.Logger
+	guestLimits   *GuestLimits
+	limiter       *Limiter
+	// closing is set once the server has started shutting down.
+	closing atomic.Bool
+	logger  *log.Logger
 }
 
-func NewClientServer(listenAddr string, store Storage) *ClientServer {
+func NewClientServer(listenAddr string, store Storage, broker Broker) *ClientServer {
 	logger := log.New(os.Stdout, "[client-server] ", log.LstdFlags)
 	err := store.StoreMessage(&templates.Message{
 		Sender:   "jake",
+		Room:     DefaultRoom,
 		Payload:  "hey guys im jake the human",
 		Datetime: time.Now(),
 	})
@@ -166,6 +824,7 @@ func NewClientServer(listenAddr string, store Storage) *ClientServer {
 
 	err = store.StoreMessage(&templates.Message{
 		Sender:   "bob",
+		Room:     DefaultRoom,
 		Payload:  "hey jake im bob. The martian.",
 		Datetime: time.Now().Add(time.Minute * 5),
 	})
@@ -175,6 +834,7 @@ func NewClientServer(listenAddr string, store Storage) *ClientServer {
 
 	err = store.StoreMessage(&templates.Message{
 		Sender:   "jake",
+		Room:     DefaultRoom,
 		Payload:  "cool! nice to meet you bob. Wanna play fortnite?",
 		Datetime: time.Now().Add(time.Minute * 10),
 	})
@@ -185,51 +845,195 @@ func NewClientServer(listenAddr string, store Storage) *ClientServer {
 	return &ClientServer{
 		listenAddr:    listenAddr,
 		store:         store,
-		clientManager: NewClientManager(store),
+		clientManager: NewClientManager(store, broker),
+		guestLimits:   GuestLimitsFromEnv(),
+		limiter:       NewLimiter(RateLimitsFromEnv()),
 		logger:        logger,
 	}
 }
 
 func (s *ClientServer) Run() error {
 	r := gin.Default()
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		return fmt.Errorf("invalid TRUSTED_PROXIES: %s", err)
+	}
 
 	r.GET("/", s.HandleHome)
+	r.GET("/rooms/:room", s.HandleHome)
+	r.GET("/rooms/:room/history", s.HandleHistory)
+	r.GET("/api/messages", s.HandleGetMessages)
+	r.GET("/api/messages/:id/thread", s.HandleGetThread)
 	r.GET("/chatroom", s.HandleWSConn)
+	r.GET("/chatroom/:room", s.HandleWSConn)
 	r.POST("/messages", s.HandleHome)
+	r.GET("/signup", s.HandleSignupPage)
+	r.POST("/signup", s.HandleSignup)
+	r.GET("/login", s.HandleLoginPage)
+	r.POST("/login", s.HandleLogin)
+	r.POST("/logout", s.HandleLogout)
+	r.GET("/dm", s.HandleInbox)
+	r.GET("/dm/:user", s.HandleConversation)
+	r.GET("/dm/:user/history", s.HandleConversationHistory)
+	r.GET("/dm/:user/socket", s.HandleDirectConn)
 	r.Static("/assets", "./assets/")
 
 	go s.clientManager.Start()
+	if admin := s.serveAdmin(); admin != nil {
+		defer admin.Close()
+	}
 
-	s.logger.Printf("Mchat Client server is live on: %s\n", s.listenAddr)
-	return http.ListenAndServe(s.listenAddr, r)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{Addr: s.listenAddr, Handler: r}
+	errs := make(chan error, 1)
+	go func() {
+		s.logger.Printf("Mchat Client server is live on: %s\n", s.listenAddr)
+		errs <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.shutdown(ctx, srv)
+}
+
+// shutdownTimeout bounds how long shutting down waits for clients to be sent
+// what is queued for them and for queued messages to be stored.
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops taking connections, drains and closes the open ones, stores
+// queued messages and closes the database.
+func (s *ClientServer) shutdown(ctx context.Context, srv *http.Server) error {
+	s.closing.Store(true)
+	// Shutdown closes the listener and waits for plain requests; websockets are
+	// hijacked, so it leaves those to the manager.
+	if err := srv.Shutdown(ctx); err != nil {
+		s.logger.Printf("error stopping http server: %s", err)
+	}
+	err := s.clientManager.Stop(ctx)
+	if err != nil {
+		s.logger.Printf("error stopping client manager: %s", err)
+	}
+	if err := s.store.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %s", err)
+	}
+	return err
+}
+
+// closeRestarting turns away a connection that arrived as the server was shutting down.
+func (s *ClientServer) closeRestarting(conn *websocket.Conn) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	conn.Close()
 }
 
 // func (s *ClientServer) HandleWSConn(w http.ResponseWriter, r *http.Request) {
 func (s *ClientServer) HandleWSConn(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	room, ok := roomParam(c)
+	if !ok {
+		c.String(http.StatusBadRequest, "invalid room name")
+		return
+	}
+	s.connect(c, room, "")
+}
+
+// connect authenticates the upgrade request and starts a client that lands in room,
+// or, for direct message pages, a client with no room that only sees its conversation with peer.
+func (s *ClientServer) connect(c *gin.Context, room, peer string) {
+	if s.closing.Load() {
+		c.String(http.StatusServiceUnavailable, "server restarting")
+		return
+	}
+	var username, role string
+	var guest *GuestLimits
+	tokenString, subprotocol := TokenFromRequest(c.Request)
+	claims, err := ClaimsFromToken(tokenString)
+	switch {
+	case err == nil:
+		// The role comes from the store rather than the token, so a demotion
+		// doesn't wait for the token to expire.
+		usr, err := s.store.GetUser(claims.Username)
+		if err != nil {
+			s.logger.Printf("connection for unknown user %s: %s", claims.Username, err)
+			c.String(http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		username, role = usr.Username, usr.Role
+	case s.guestLimits.Enabled && peer == "":
+		if !s.guestLimits.CanJoin(room) {
+			c.String(http.StatusForbidden, "guests can't join this room")
+			return
+		}
+		username, guest = s.clientManager.guestName(), s.guestLimits
+	default:
+		s.logger.Printf("unauthenticated connection from: %s (%s)", c.Request.RemoteAddr, err)
+		c.String(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if peer != "" && (peer == username || !s.clientManager.knowsUser(peer)) {
+		c.String(http.StatusNotFound, "no such user")
+		return
+	}
+	ip := c.ClientIP()
+	if guest == nil {
+		if left := s.limiter.BannedFor(userKey(username)); left > 0 {
+			retryAfter(c, left)
+			c.String(http.StatusForbidden, bannedError(left).Error())
+			return
+		}
+	}
+	limit := s.limiter.limits.Connections[permission(role, guest != nil)]
+	if status, err := s.throttle(c, ipKey(ip), "connections", limit); err != nil {
+		s.logger.Printf("refused connection from: %s (%s)", ip, err)
+		c.String(status, err.Error())
+		return
+	}
+	format := FormatHTML
+	if slices.Contains(websocket.Subprotocols(c.Request), protocol.Subprotocol) {
+		// Only one subprotocol can be echoed, and the client offered this one too.
+		format, subprotocol = FormatJSON, protocol.Subprotocol
+	} else if c.Query("format") == FormatJSON {
+		format = FormatJSON
+	}
+	var header http.Header
+	if subprotocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, header)
 	if err != nil {
 		s.logger.Printf("failed to establish connection.")
 		return
 	}
-	// TODO: USER AUTHENTICATION & AUTHORIZATION
-	// tokenString := conn.Request().Header.Get("Sec-WebSocket-Protocol")
-	// token, err := validateJWT(tokenString)
-	// if err != nil {
-	// 	s.logger.Printf("unauthenticated connection from: %+v\n", conn.RemoteAddr())
-	// 	conn.Close()
-	// 	return
-	// }
-	// _, ok := token.Claims.(*AuthClaims)
-	// if !ok {
-	// 	s.logger.Printf("claims convertion failed.")
-	// 	conn.Close()
-	// 	return
-	// }
-	// client := NewClient(token.Claims.(*AuthClaims).Username, conn, s.clientManager)
-	client := NewClient("user", conn, s.clientManager)
+	client := NewClient(username, room, conn, s.clientManager)
+	client.guest = guest
+	client.ip = ip
+	client.limiter = s.limiter
+	client.format = format
+	client.peer = peer
+	client.role = role
+	client.since = sinceParam(c.Query("since"))
+	if client.since > 0 {
+		if err := s.clientManager.loadReplay(client); err != nil {
+			s.logger.Printf("error replaying messages: %s", err)
+			client.since = 0
+		}
+	}
+	if guest == nil {
+		if client.unread, err = s.store.GetUnreadCounts(username); err != nil {
+			s.logger.Printf("error getting unread counts: %s", err)
+		}
+	}
 	s.logger.Printf("New Connection: %+v", client)
 
-	s.clientManager.registerClient <- client
+	if !s.clientManager.register(client) {
+		s.closeRestarting(conn)
+		return
+	}
 
 	go func(client *Client) {
 		err := client.read()
@@ -239,6 +1043,7 @@ func (s *ClientServer) HandleWSConn(c *gin.Context) {
 		err := client.write()
 		log.Printf("write err: %s", err)
 	}(client)
+	go client.ping()
 }
 
 // func (s *ClientServer) HandlePostMessages(w http.ResponseWriter, r *http.Request) {
@@ -250,6 +1055,7 @@ func (s *ClientServer) HandlePostMessages(c *gin.Context) {
 	msg := &templates.Message{
 		Payload: c.Request.Form.Get("payload"),
 		Sender:  c.Request.Form.Get("sender"),
+		Room:    DefaultRoom,
 	}
 	if msg.Payload == "" {
 		// w.Write([]byte("empty message"))
@@ -267,9 +1073,30 @@ func (s *ClientServer) HandlePostMessages(c *gin.Context) {
 
 // func (s *ClientServer) HandleHome(w http.ResponseWriter, r *http.Request) {
 func (s *ClientServer) HandleHome(c *gin.Context) {
-	messages, err := s.store.GetMessages()
+	room, ok := roomParam(c)
+	if !ok {
+		c.String(http.StatusBadRequest, "invalid room name")
+		return
+	}
+	guest, ok := s.canRead(c, room)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+	q := &MessageQuery{Room: room}
+	messages, err := s.getMessages(q)
 	if err != nil {
 		s.logger.Println(err)
 	}
-	templates.WsChat(messages).Render(c.Request.Context(), c.Writer)
+	s.withReceipts(messages, room, "", "")
+	templates.WsChat(room, guest, messages, olderURL(roomHistory(room), messages, q.PageSize())).Render(c.Request.Context(), c.Writer)
+}
+
+// roomParam returns the :room path parameter, falling back to DefaultRoom when the route has none.
+func roomParam(c *gin.Context) (string, bool) {
+	room := c.Param("room")
+	if room == "" {
+		return DefaultRoom, true
+	}
+	return room, ValidRoomName(room)
 }
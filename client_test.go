@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewMessageIgnoresForgedFields(t *testing.T) {
+	c := &Client{username: "alice", room: "lobby"}
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"htmx form", `{"payload":"hi","parent_id":7,"deleted":true,"edited":true,"replies":3,"seen_by":["bob"],"reactions":[{"emoji":"👍","users":["bob","carol"]}]}`},
+		{"envelope", `{"v":1,"type":"message","payload":"hi","id":"42","sender":"mallory","room":"secret","datetime":"2001-01-01T00:00:00Z","parent_id":7,"seen_by":["bob"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &inboundMessage{}
+			if err := json.Unmarshal([]byte(tt.frame), in); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := c.newMessage(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Payload != "hi" || msg.Sender != "alice" || msg.Room != "lobby" {
+				t.Errorf("got payload %q from %q in %q, want \"hi\" from \"alice\" in \"lobby\"", msg.Payload, msg.Sender, msg.Room)
+			}
+			if msg.Id != 0 || msg.ParentId != 0 || msg.Deleted || msg.Edited || msg.Replies != 0 || msg.Reactions != nil || msg.SeenBy != nil {
+				t.Errorf("client set server owned fields: %+v", msg)
+			}
+			if msg.Datetime.Year() == 2001 {
+				t.Errorf("client set the timestamp")
+			}
+		})
+	}
+}
+
+func TestNewMessageRejectsEmptyPayloads(t *testing.T) {
+	c := &Client{username: "alice", room: "lobby"}
+	for _, payload := range []string{"", "   ", "\n\t"} {
+		if _, err := c.newMessage(&inboundMessage{Payload: payload}); err == nil {
+			t.Errorf("newMessage(%q) succeeded, want an error", payload)
+		}
+	}
+	msg, err := c.newMessage(&inboundMessage{Payload: "  hi \n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload != "hi" {
+		t.Errorf("newMessage trimmed to %q, want \"hi\"", msg.Payload)
+	}
+}
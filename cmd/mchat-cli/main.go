@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/muhreeowki/mchat/protocol"
+)
+
+// mchat-cli is a line oriented terminal client for mchat.
+//
+// Lines are sent to the current room as messages. Lines starting with "/" are
+// chat commands handled by the server (/join, /who, /msg, /help, ...). Lines
+// starting with ":" are handled locally:
+//
+//	:history [n]  print the last n lines of scrollback
+//	:unread       list rooms and conversations with unread messages
+//	:quit         disconnect and exit
+//
+// If the connection drops, the client reconnects and the server replays the
+// messages it missed.
+func main() {
+	server := flag.String("server", "http://localhost:3000", "mchat server address")
+	username := flag.String("user", "", "username to log in as (empty connects as a guest)")
+	room := flag.String("room", "lobby", "room to join")
+	scrollback := flag.Int("scrollback", 500, "number of lines of scrollback to keep")
+	flag.Parse()
+
+	stdin := bufio.NewScanner(os.Stdin)
+
+	token := ""
+	if *username != "" {
+		password := os.Getenv("MCHAT_PASSWORD")
+		if password == "" {
+			fmt.Print("password: ")
+			if !stdin.Scan() {
+				os.Exit(1)
+			}
+			password = stdin.Text()
+		}
+		var err error
+		token, err = login(*server, *username, password)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	conn, err := dial(*server, *room, token, 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	c := &cli{conn: conn, server: *server, token: token, room: *room, limit: *scrollback}
+	c.println(fmt.Sprintf("* connected to #%s. Type /help for commands, :quit to exit.", *room))
+	go func() {
+		for c.reconnect(c.receive()) {
+		}
+		os.Exit(0)
+	}()
+
+	for stdin.Scan() {
+		if err := c.handle(strings.TrimSpace(stdin.Text())); err != nil {
+			c.println(fmt.Sprintf("* %s", err))
+		}
+	}
+}
+
+// login exchanges credentials for a session token.
+func login(server, username, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	resp, err := http.Post(strings.TrimSuffix(server, "/")+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Token string `json:"token"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("login failed: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login failed: %s", out.Error)
+	}
+	return out.Token, nil
+}
+
+// dial opens the room's websocket, negotiating JSON envelopes through the
+// subprotocol. A non-zero since asks the server to replay newer messages.
+func dial(server, room, token string, since int) (*websocket.Conn, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = "/chatroom/" + room
+	if since > 0 {
+		u.RawQuery = url.Values{"since": {strconv.Itoa(since)}}.Encode()
+	}
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocol.Subprotocol}
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect: %s", err)
+	}
+	if conn.Subprotocol() != protocol.Subprotocol {
+		conn.Close()
+		return nil, fmt.Errorf("server does not speak %s", protocol.Subprotocol)
+	}
+	return conn, nil
+}
+
+// reconnectAttempts is how many times the client tries to reconnect before giving up.
+const reconnectAttempts = 10
+
+type cli struct {
+	conn   *websocket.Conn
+	server string
+	token  string
+	limit  int
+
+	// wmu serializes writes to conn, which the receive loop also writes to.
+	wmu sync.Mutex
+
+	mu         sync.Mutex
+	room       string
+	scrollback []string
+	unread     map[string]int
+	// lastID is the newest message seen, for the server to replay from on reconnect.
+	lastID int
+	// readDue is set while a read receipt for lastID waits to be sent.
+	readDue bool
+}
+
+func (c *cli) send(env *protocol.Envelope) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	env.Version = protocol.Version
+	return c.conn.WriteJSON(env)
+}
+
+// receive prints every message the server sends until the connection closes.
+func (c *cli) receive() error {
+	for {
+		env := new(protocol.Envelope)
+		if err := c.conn.ReadJSON(env); err != nil {
+			return err
+		}
+		if env.Version != protocol.Version {
+			c.println(fmt.Sprintf("* ignoring envelope with unsupported version %d", env.Version))
+			continue
+		}
+		if env.Type == protocol.TypeUnread {
+			c.mu.Lock()
+			c.unread = env.Unread
+			c.mu.Unlock()
+			continue
+		}
+		// The server only sends the online list of the room the client is in,
+		// so it says where a /join or /leave took it, if anywhere.
+		if env.Type == protocol.TypePresence && env.Room != "" {
+			c.mu.Lock()
+			c.room = env.Room
+			c.mu.Unlock()
+		}
+		if line := format(env); line != "" {
+			c.println(line)
+		}
+		// Anything printed has been read.
+		if (env.Type == protocol.TypeMessage && env.Parent == "") || env.Type == protocol.TypeWhisper {
+			if id, err := strconv.Atoi(env.ID); err == nil {
+				c.seen(id)
+			}
+		}
+	}
+}
+
+// readDelay is how long the client gathers printed messages before sending a
+// read receipt, so a burst or a replay is marked read with one.
+const readDelay = time.Second
+
+// seen records that message id was printed, and marks it read after readDelay
+// along with any printed meanwhile. Only the newest is sent, which marks
+// everything before it read.
+func (c *cli) seen(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastID = max(c.lastID, id)
+	if c.readDue {
+		return
+	}
+	c.readDue = true
+	time.AfterFunc(readDelay, func() {
+		c.mu.Lock()
+		last := c.lastID
+		c.readDue = false
+		c.mu.Unlock()
+		c.send(&protocol.Envelope{Type: protocol.TypeRead, ID: strconv.Itoa(last)})
+	})
+}
+
+// reconnect dials the server again after the connection dropped with err,
+// backing off between attempts. It reports false if the server closed the
+// connection on purpose or every attempt failed.
+func (c *cli) reconnect(err error) bool {
+	c.println(fmt.Sprintf("* disconnected: %s", err))
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.ClosePolicyViolation, websocket.CloseMessageTooBig) {
+		return false
+	}
+	delay := time.Second
+	for range reconnectAttempts {
+		time.Sleep(delay)
+		delay = min(2*delay, 30*time.Second)
+		c.mu.Lock()
+		room, since := c.room, c.lastID
+		c.mu.Unlock()
+		conn, err := dial(c.server, room, c.token, since)
+		if err != nil {
+			c.println(fmt.Sprintf("* reconnecting: %s", err))
+			continue
+		}
+		c.wmu.Lock()
+		c.conn.Close()
+		c.conn = conn
+		c.wmu.Unlock()
+		c.println(fmt.Sprintf("* reconnected to #%s", room))
+		return true
+	}
+	return false
+}
+
+// handle runs a local ":" command or sends line to the server.
+func (c *cli) handle(line string) error {
+	switch {
+	case line == "":
+		return nil
+	case line == ":quit":
+		c.wmu.Lock()
+		c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		os.Exit(0)
+	case line == ":unread":
+		c.printUnread()
+		return nil
+	case strings.HasPrefix(line, ":history"):
+		n := 20
+		if arg := strings.TrimSpace(strings.TrimPrefix(line, ":history")); arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil {
+				return fmt.Errorf("usage: :history [n]")
+			}
+		}
+		c.history(n)
+		return nil
+	case strings.HasPrefix(line, ":"):
+		return fmt.Errorf("unknown local command %s (try :history, :unread or :quit)", line)
+	}
+	return c.send(&protocol.Envelope{Type: protocol.TypeMessage, Payload: line})
+}
+
+// println prints line and keeps it in the scrollback.
+func (c *cli) println(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scrollback = append(c.scrollback, line)
+	if len(c.scrollback) > c.limit {
+		c.scrollback = c.scrollback[len(c.scrollback)-c.limit:]
+	}
+	fmt.Println(line)
+}
+
+func (c *cli) printUnread() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := []string{}
+	for name, n := range c.unread {
+		if n > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Println("* all caught up")
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("* %s: %d unread\n", name, c.unread[name])
+	}
+}
+
+func (c *cli) history(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := max(len(c.scrollback)-n, 0)
+	fmt.Printf("--- last %d lines (in #%s) ---\n", len(c.scrollback)-start, c.room)
+	for _, line := range c.scrollback[start:] {
+		fmt.Println(line)
+	}
+	fmt.Println("---")
+}
+
+// format renders env as a line of output, or "" if it isn't worth printing.
+func format(env *protocol.Envelope) string {
+	ts := env.Timestamp.Local().Format("15:04")
+	switch env.Type {
+	case protocol.TypeSystem, protocol.TypeReply, protocol.TypeReload:
+		return fmt.Sprintf("%s * %s", ts, strings.ReplaceAll(env.Payload, "\n", "\n      * "))
+	case protocol.TypeEdit:
+		return fmt.Sprintf("%s * %s edited message %s: %s", ts, env.Sender, env.ID, env.Payload)
+	case protocol.TypeDelete:
+		return fmt.Sprintf("%s * message %s by %s was deleted", ts, env.ID, env.Sender)
+	case protocol.TypeReact:
+		counts := []string{}
+		for emoji, n := range env.Reactions {
+			counts = append(counts, fmt.Sprintf("%s %d", emoji, n))
+		}
+		return fmt.Sprintf("%s * reactions on message %s: %s", ts, env.ID, strings.Join(counts, " "))
+	case protocol.TypeThread:
+		if env.ID == "" {
+			return fmt.Sprintf("%s * thread closed", ts)
+		}
+		return fmt.Sprintf("%s * message %s by %s has %d replies", ts, env.ID, env.Sender, env.Replies)
+	case protocol.TypePresence:
+		users := []string{}
+		for _, u := range env.Users {
+			if u.Status == protocol.StatusAway {
+				users = append(users, u.Username+" (away)")
+			} else {
+				users = append(users, u.Username)
+			}
+		}
+		return fmt.Sprintf("%s * online in #%s: %s", ts, env.Room, strings.Join(users, ", "))
+	case protocol.TypeRead:
+		// Receipts are for the web UI.
+		return ""
+	case protocol.TypeTyping:
+		// Skip the empty lists sent when everyone stops typing.
+		users := []string{}
+		for _, u := range env.Users {
+			users = append(users, u.Username)
+		}
+		if len(users) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%s * typing in #%s: %s", ts, env.Room, strings.Join(users, ", "))
+	case protocol.TypeWhisper:
+		return fmt.Sprintf("%s %s -> %s: %s", ts, env.Sender, env.Recipient, env.Payload)
+	default:
+		if env.Parent != "" {
+			return fmt.Sprintf("%s [#%s thread %s] %s: %s", ts, env.Room, env.Parent, env.Sender, env.Payload)
+		}
+		return fmt.Sprintf("%s [#%s] %s: %s", ts, env.Room, env.Sender, env.Payload)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// Permission is the level a client needs to run a command.
+type Permission int
+
+const (
+	PermGuest Permission = iota
+	PermUser
+	PermModerator
+)
+
+// errUsage makes the dispatcher reply with the command's usage line.
+var errUsage = errors.New("usage")
+
+// Command is a slash command clients can run from the message box.
+type Command struct {
+	Name        string
+	Usage       string
+	Description string
+	Permission  Permission
+	Run         func(ctx *CommandContext) error
+}
+
+// CommandContext is what a command gets to work with when it runs.
+// Commands run on the calling client's read goroutine.
+type CommandContext struct {
+	Client *Client
+	Args   []string
+	// Text is everything after the command name, untouched.
+	Text string
+}
+
+// Reply sends lines back to the calling client only.
+func (ctx *CommandContext) Reply(lines ...string) {
+	msg := &templates.Message{
+		Sender:    SystemSender,
+		Recipient: ctx.Client.username,
+		Payload:   strings.Join(lines, "\n"),
+		Datetime:  time.Now(),
+	}
+	send(ctx.Client.manager, ctx.Client.manager.system, &systemMessage{client: ctx.Client, frame: newFrame(templates.WsCommandReply(lines), protocol.TypeReply, msg)})
+}
+
+type CommandRegistry struct {
+	commands map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		commands: make(map[string]*Command),
+	}
+}
+
+// Register adds cmd to the registry, replacing any command with the same name.
+func (r *CommandRegistry) Register(cmd *Command) {
+	r.commands[strings.ToLower(cmd.Name)] = cmd
+}
+
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	cmd, ok := r.commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// Commands returns every registered command sorted by name.
+func (r *CommandRegistry) Commands() []*Command {
+	cmds := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		cmds = append(cmds, cmd)
+	}
+	slices.SortFunc(cmds, func(a, b *Command) int { return strings.Compare(a.Name, b.Name) })
+	return cmds
+}
+
+// Permission returns the level of commands the client may run.
+func (c *Client) Permission() Permission {
+	return permission(c.role, c.guest != nil)
+}
+
+// permission returns the level of a session with role, or of a guest.
+func permission(role string, guest bool) Permission {
+	switch {
+	case guest:
+		return PermGuest
+	case role == RoleModerator:
+		return PermModerator
+	default:
+		return PermUser
+	}
+}
+
+// runCommand parses a "/name args..." line and dispatches it to the registry.
+func (c *Client) runCommand(line string) {
+	name, text, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	ctx := &CommandContext{
+		Client: c,
+		Args:   strings.Fields(text),
+		Text:   strings.TrimSpace(text),
+	}
+	cmd, ok := c.manager.commands.Lookup(name)
+	if !ok {
+		ctx.Reply(fmt.Sprintf("Unknown command /%s. Try /help.", name))
+		return
+	}
+	if c.Permission() < cmd.Permission {
+		ctx.Reply(fmt.Sprintf("You don't have permission to use /%s.", cmd.Name))
+		return
+	}
+	if err := cmd.Run(ctx); err != nil {
+		if errors.Is(err, errUsage) {
+			ctx.Reply("Usage: " + cmd.Usage)
+			return
+		}
+		ctx.Reply(err.Error())
+	}
+}
+
+// DefaultCommands returns a registry with the built-in chat commands.
+func DefaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+	r.Register(&Command{
+		Name:        "help",
+		Usage:       "/help",
+		Description: "List the commands you can use.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			lines := []string{}
+			for _, cmd := range ctx.Client.manager.commands.Commands() {
+				if ctx.Client.Permission() >= cmd.Permission {
+					lines = append(lines, fmt.Sprintf("%s - %s", cmd.Usage, cmd.Description))
+				}
+			}
+			ctx.Reply(lines...)
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name:        "join",
+		Usage:       "/join <room>",
+		Description: "Move to another room.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			if len(ctx.Args) != 1 {
+				return errUsage
+			}
+			if err := ctx.Client.join(strings.TrimPrefix(ctx.Args[0], "#")); err != nil {
+				return err
+			}
+			ctx.Reply(fmt.Sprintf("You joined #%s.", ctx.Client.room))
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name:        "leave",
+		Usage:       "/leave",
+		Description: "Go back to the lobby.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			ctx.Client.leave()
+			ctx.Reply(fmt.Sprintf("You are back in #%s.", ctx.Client.room))
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name:        "who",
+		Usage:       "/who",
+		Description: "List who is in this room.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			names := ctx.Client.manager.usernames(ctx.Client.room)
+			ctx.Reply(fmt.Sprintf("In #%s: %s", ctx.Client.room, strings.Join(names, ", ")))
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name:        "nick",
+		Usage:       "/nick <name>",
+		Description: "Pick a guest nickname.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			if len(ctx.Args) != 1 {
+				return errUsage
+			}
+			if ctx.Client.guest == nil {
+				return fmt.Errorf("Your name is tied to your account and can't be changed.")
+			}
+			nick := GuestPrefix + strings.TrimPrefix(ctx.Args[0], GuestPrefix)
+			if err := validUsername(nick, true); err != nil {
+				return fmt.Errorf("That nickname can't be used: %s.", err)
+			}
+			if !ctx.Client.manager.rename(ctx.Client, nick) {
+				return fmt.Errorf("%s is already taken.", nick)
+			}
+			ctx.Reply(fmt.Sprintf("You are now known as %s.", nick))
+			return nil
+		},
+	})
+	r.Register(&Command{
+		Name:        "me",
+		Usage:       "/me <action>",
+		Description: "Describe what you're doing.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			if ctx.Text == "" {
+				return errUsage
+			}
+			msg := &templates.Message{
+				Sender:   ctx.Client.username,
+				Room:     ctx.Client.room,
+				Payload:  fmt.Sprintf("* %s %s", ctx.Client.username, ctx.Text),
+				Datetime: time.Now(),
+			}
+			if err := ctx.Client.checkGuestLimits(msg); err != nil {
+				return err
+			}
+			return ctx.Client.post(msg)
+		},
+	})
+	r.Register(&Command{
+		Name:        "msg",
+		Usage:       "/msg <user> <message>",
+		Description: "Send a private message.",
+		Permission:  PermGuest,
+		Run: func(ctx *CommandContext) error {
+			if len(ctx.Args) < 2 {
+				return errUsage
+			}
+			msg := &templates.Message{
+				Sender:    ctx.Client.username,
+				Recipient: ctx.Args[0],
+				Payload:   strings.TrimSpace(strings.TrimPrefix(ctx.Text, ctx.Args[0])),
+				Datetime:  time.Now(),
+			}
+			if msg.Payload == "" {
+				return errUsage
+			}
+			if !ctx.Client.manager.knowsUser(msg.Recipient) {
+				return fmt.Errorf("There is no user called %s.", msg.Recipient)
+			}
+			if err := ctx.Client.checkGuestLimits(msg); err != nil {
+				return err
+			}
+			return ctx.Client.post(msg)
+		},
+	})
+	return r
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// HandleInbox lists the logged in user's direct message conversations.
+func (s *ClientServer) HandleInbox(c *gin.Context) {
+	username, ok := sessionUser(c)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+	latest, err := s.store.GetInbox(username)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	counts, err := s.store.GetUnreadCounts(username)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	unread := make(map[string]int)
+	for conversation, n := range counts {
+		if peer, ok := strings.CutPrefix(conversation, "@"); ok {
+			unread[peer] = n
+		}
+	}
+	templates.Inbox(username, latest, unread).Render(c.Request.Context(), c.Writer)
+}
+
+// conversationPeer returns the logged in user and the :user they are
+// talking to, answering the request itself if there is no such conversation.
+func (s *ClientServer) conversationPeer(c *gin.Context) (username, peer string, ok bool) {
+	username, ok = sessionUser(c)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, "/login")
+		return "", "", false
+	}
+	peer = c.Param("user")
+	if peer == username || !s.clientManager.knowsUser(peer) {
+		c.String(http.StatusNotFound, "no such user")
+		return "", "", false
+	}
+	return username, peer, true
+}
+
+// conversationHistory is the path of peer's HandleConversationHistory.
+func conversationHistory(peer string) string {
+	return "/dm/" + peer + "/history"
+}
+
+// HandleConversation renders the latest direct messages between the logged in
+// user and :user; older ones load as the feed scrolls up.
+func (s *ClientServer) HandleConversation(c *gin.Context) {
+	username, peer, ok := s.conversationPeer(c)
+	if !ok {
+		return
+	}
+	q := &MessageQuery{Between: [2]string{username, peer}}
+	messages, err := s.getMessages(q)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	s.withReceipts(messages, "", username, peer)
+	moreURL := olderURL(conversationHistory(peer), messages, q.PageSize())
+	templates.DirectChat(username, peer, messages, moreURL).Render(c.Request.Context(), c.Writer)
+}
+
+// HandleConversationHistory renders an older page of a direct message
+// conversation for infinite scroll.
+func (s *ClientServer) HandleConversationHistory(c *gin.Context) {
+	username, peer, ok := s.conversationPeer(c)
+	if !ok {
+		return
+	}
+	q, err := parseMessageQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	q.Room, q.Sender = "", ""
+	q.Between = [2]string{username, peer}
+	messages, err := s.getMessages(q)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	s.withReceipts(messages, "", username, peer)
+	templates.OlderMessages(messages, olderURL(conversationHistory(peer), messages, q.PageSize())).Render(c.Request.Context(), c.Writer)
+}
+
+// HandleDirectConn opens the websocket behind a direct message page.
+func (s *ClientServer) HandleDirectConn(c *gin.Context) {
+	s.connect(c, "", c.Param("user"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/a-h/templ"
+	"github.com/google/uuid"
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// Wire formats a client can ask for when it connects.
+const (
+	// FormatHTML sends rendered htmx fragments, for browsers.
+	FormatHTML = "html"
+	// FormatJSON sends protocol.Envelope values, for API and CLI clients.
+	FormatJSON = "json"
+)
+
+// frame is something the manager sends to clients. It carries both a
+// representation for htmx browsers and one for JSON clients, and encodes each
+// at most once however many clients it fans out to.
+type frame struct {
+	html     templ.Component
+	envelope *protocol.Envelope
+	cache    map[string][]byte
+	// key names the state this frame carries in full, like a room's online
+	// list. A newer frame with the same key makes a queued one redundant.
+	key string
+}
+
+// newFrame builds a frame of the given envelope type around msg, rendered with html for browsers.
+func newFrame(html templ.Component, typ string, msg *templates.Message) *frame {
+	id := uuid.NewString()
+	if msg.Id != 0 {
+		id = strconv.Itoa(msg.Id)
+	}
+	parent := ""
+	if msg.ParentId != 0 {
+		parent = strconv.Itoa(msg.ParentId)
+	}
+	var reactions map[string]int
+	if len(msg.Reactions) > 0 {
+		reactions = make(map[string]int, len(msg.Reactions))
+		for _, r := range msg.Reactions {
+			reactions[r.Emoji] = len(r.Users)
+		}
+	}
+	return &frame{
+		html: html,
+		envelope: &protocol.Envelope{
+			Version:   protocol.Version,
+			Type:      typ,
+			ID:        id,
+			Room:      msg.Room,
+			Sender:    msg.Sender,
+			Recipient: msg.Recipient,
+			Payload:   msg.Payload,
+			Timestamp: msg.Datetime,
+			Parent:    parent,
+			Replies:   msg.Replies,
+			Reactions: reactions,
+		},
+	}
+}
+
+// encode returns the frame's bytes in the given wire format.
+func (f *frame) encode(format string) ([]byte, error) {
+	if b, ok := f.cache[format]; ok {
+		return b, nil
+	}
+	var b []byte
+	if format == FormatJSON {
+		var err error
+		if b, err = json.Marshal(f.envelope); err != nil {
+			return nil, err
+		}
+	} else {
+		buf := new(bytes.Buffer)
+		if err := f.html.Render(context.Background(), buf); err != nil {
+			return nil, err
+		}
+		b = buf.Bytes()
+	}
+	if f.cache == nil {
+		f.cache = make(map[string][]byte)
+	}
+	f.cache[format] = b
+	return b, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GuestPrefix starts every guest username, and is reserved so registered users can't take it.
+const GuestPrefix = "guest-"
+
+// GuestLimits restricts what anonymous guest sessions may do.
+type GuestLimits struct {
+	Enabled          bool
+	MaxMessageLength int
+	// Rooms lists the rooms guests may join. An empty list allows every room.
+	Rooms           []string
+	SessionLifetime time.Duration
+}
+
+// GuestLimitsFromEnv reads guest limits from the environment, falling back to conservative defaults.
+// Guests are off unless GUESTS_ENABLED=true.
+func GuestLimitsFromEnv() *GuestLimits {
+	limits := &GuestLimits{
+		Enabled:          os.Getenv("GUESTS_ENABLED") == "true",
+		MaxMessageLength: envInt("GUEST_MAX_MESSAGE_LENGTH", 280),
+		Rooms:            []string{DefaultRoom},
+		SessionLifetime:  time.Hour,
+	}
+	if rooms := os.Getenv("GUEST_ROOMS"); rooms != "" {
+		limits.Rooms = nil
+		if rooms != "*" {
+			for _, room := range strings.Split(rooms, ",") {
+				limits.Rooms = append(limits.Rooms, strings.TrimSpace(room))
+			}
+		}
+	}
+	if lifetime, err := time.ParseDuration(os.Getenv("GUEST_SESSION_LIFETIME")); err == nil {
+		limits.SessionLifetime = lifetime
+	}
+	return limits
+}
+
+func (l *GuestLimits) CanJoin(room string) bool {
+	return len(l.Rooms) == 0 || slices.Contains(l.Rooms, room)
+}
+
+// NewGuestName mints a random guest-xxxxxxxx username. Names can still collide,
+// so the manager mints another if one is taken when the guest registers.
+func NewGuestName() string {
+	return GuestPrefix + uuid.NewString()[:8]
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// envDuration reads a positive duration such as "30s" from the environment.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Heartbeat defaults. WS_PING_INTERVAL, WS_PONG_TIMEOUT, WS_WRITE_TIMEOUT and
+// WS_MAX_MESSAGE_BYTES override them.
+const (
+	DefaultPingInterval    = 30 * time.Second
+	DefaultPongTimeout     = 60 * time.Second
+	DefaultWriteTimeout    = 10 * time.Second
+	DefaultMaxMessageBytes = 64 << 10
+)
+
+// HeartbeatConfig says how connections are kept alive and when a peer is given up on.
+type HeartbeatConfig struct {
+	// PingInterval is how often the server pings each client.
+	PingInterval time.Duration
+	// PongTimeout is how long a client can go without answering a ping or
+	// sending anything else before its connection is reaped.
+	PongTimeout time.Duration
+	// WriteTimeout bounds every write, so a peer that stops reading is reaped too.
+	WriteTimeout time.Duration
+	// MaxMessageBytes is the largest message a client may send.
+	MaxMessageBytes int64
+}
+
+// HeartbeatConfigFromEnv reads the heartbeat settings from the environment. The
+// pong timeout is raised to twice the ping interval if it would expire before the next ping.
+func HeartbeatConfigFromEnv() HeartbeatConfig {
+	cfg := HeartbeatConfig{
+		PingInterval:    envDuration("WS_PING_INTERVAL", DefaultPingInterval),
+		PongTimeout:     envDuration("WS_PONG_TIMEOUT", DefaultPongTimeout),
+		WriteTimeout:    envDuration("WS_WRITE_TIMEOUT", DefaultWriteTimeout),
+		MaxMessageBytes: int64(max(envInt("WS_MAX_MESSAGE_BYTES", DefaultMaxMessageBytes), 1)),
+	}
+	if cfg.PongTimeout <= cfg.PingInterval {
+		cfg.PongTimeout = 2 * cfg.PingInterval
+	}
+	return cfg
+}
+
+// keepAlive sets the read limit and deadline, and pushes the deadline back whenever
+// the client answers a ping. It is called from the read goroutine before reading.
+func (c *Client) keepAlive() {
+	cfg := c.manager.heartbeat
+	c.conn.SetReadLimit(cfg.MaxMessageBytes)
+	c.extendDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendDeadline()
+		return nil
+	})
+}
+
+// extendDeadline gives the client another pong timeout to be heard from.
+func (c *Client) extendDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(c.manager.heartbeat.PongTimeout))
+}
+
+// ping pings the client every ping interval until its write goroutine stops.
+func (c *Client) ping() {
+	cfg := c.manager.heartbeat
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.written:
+			return
+		case <-ticker.C:
+			// WriteControl is safe to call alongside the write goroutine.
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.WriteTimeout)); err != nil {
+				c.reap(err)
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// reap counts the client as a dead peer if err is a read or write timing out.
+// Each connection is only counted once, however many goroutines notice.
+func (c *Client) reap(err error) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return
+	}
+	if c.reaped.CompareAndSwap(false, true) {
+		metrics.Add("connections_reaped", 1)
+		log.Printf("reaping unresponsive connection (%s): %s", c.conn.RemoteAddr(), err)
+	}
+}
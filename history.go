@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// canRead reports whether the request may see room's history, and whether it's a guest.
+func (s *ClientServer) canRead(c *gin.Context, room string) (guest bool, ok bool) {
+	if _, loggedIn := sessionUser(c); loggedIn {
+		return false, true
+	}
+	return true, s.guestLimits.Enabled && s.guestLimits.CanJoin(room)
+}
+
+// parseMessageQuery reads a MessageQuery from the request's query string.
+func parseMessageQuery(c *gin.Context) (*MessageQuery, error) {
+	q := &MessageQuery{
+		Room:   c.Query("room"),
+		Sender: c.Query("sender"),
+	}
+	ints := map[string]*int{"before": &q.Before, "after": &q.After, "limit": &q.Limit}
+	for key, dst := range ints {
+		if v := c.Query(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s: %q", key, v)
+			}
+			*dst = n
+		}
+	}
+	times := map[string]*time.Time{"since": &q.Since, "until": &q.Until}
+	for key, dst := range times {
+		if v := c.Query(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q (want RFC 3339)", key, v)
+			}
+			*dst = t
+		}
+	}
+	if q.Room != "" && !ValidRoomName(q.Room) {
+		return nil, fmt.Errorf("invalid room name")
+	}
+	return q, nil
+}
+
+// olderURL returns where to load the page before messages from the history
+// endpoint at path, or "" if there isn't one.
+func olderURL(path string, messages []*templates.Message, pageSize int) string {
+	if len(messages) < pageSize {
+		return ""
+	}
+	v := url.Values{"before": {strconv.Itoa(messages[0].Id)}}
+	return path + "?" + v.Encode()
+}
+
+// getMessages runs q, including the messages still waiting to be stored.
+func (s *ClientServer) getMessages(q *MessageQuery) ([]*templates.Message, error) {
+	messages, err := s.clientManager.persist.withUnstored(func() ([]*templates.Message, error) {
+		return s.store.GetMessages(q)
+	}, q.matches)
+	if err != nil {
+		return nil, err
+	}
+	if extra := len(messages) - q.PageSize(); extra > 0 {
+		if q.forward() {
+			messages = messages[:q.PageSize()]
+		} else {
+			messages = messages[extra:]
+		}
+	}
+	return messages, nil
+}
+
+// HandleGetMessages is the JSON message history API.
+//
+//	GET /api/messages?room=&sender=&since=&until=&before=&after=&limit=
+func (s *ClientServer) HandleGetMessages(c *gin.Context) {
+	q, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if q.Room == "" {
+		q.Room = DefaultRoom
+	}
+	if _, ok := s.canRead(c, q.Room); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	messages, err := s.getMessages(q)
+	if err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get messages"})
+		return
+	}
+	resp := gin.H{"messages": messages}
+	if len(messages) == q.PageSize() {
+		resp["before"] = messages[0].Id
+		resp["after"] = messages[len(messages)-1].Id
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandleGetThread returns a room message and the replies in its thread.
+//
+//	GET /api/messages/:id/thread
+func (s *ClientServer) HandleGetThread(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid message id"})
+		return
+	}
+	root, err := s.clientManager.store.GetMessage(id)
+	if err != nil || root.Recipient != "" || root.ParentId != 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+		return
+	}
+	if _, ok := s.canRead(c, root.Room); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	replies, err := s.clientManager.thread(id)
+	if err != nil {
+		s.logger.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get thread"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": root, "replies": replies})
+}
+
+// roomHistory is the path of room's HandleHistory.
+func roomHistory(room string) string {
+	return "/rooms/" + room + "/history"
+}
+
+// HandleHistory renders an older page of a room's feed for infinite scroll.
+func (s *ClientServer) HandleHistory(c *gin.Context) {
+	room, ok := roomParam(c)
+	if !ok {
+		c.String(http.StatusBadRequest, "invalid room name")
+		return
+	}
+	if _, ok := s.canRead(c, room); !ok {
+		c.String(http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	q, err := parseMessageQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	q.Room = room
+	messages, err := s.getMessages(q)
+	if err != nil {
+		s.logger.Println(err)
+	}
+	s.withReceipts(messages, room, "", "")
+	templates.OlderMessages(messages, olderURL(roomHistory(room), messages, q.PageSize())).Render(c.Request.Context(), c.Writer)
+}
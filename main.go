@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	_ "github.com/lib/pq"
 )
@@ -14,18 +15,41 @@ import (
 //    - Handle guests and limiting guest usage
 
 func main() {
-	store, err := NewPostgresStore()
+	store, err := NewStore()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 	// store.Drop()
 	// return
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(store, os.Args[2:]); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
 	if err := store.Init(); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	clientServer := NewClientServer(":3000", store)
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		if err := runRole(store, os.Args[2:]); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if err := checkJWTSecret(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	broker, err := NewBroker()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	clientServer := NewClientServer(":3000", store, broker)
 	if err := clientServer.Run(); err != nil {
 		log.Fatal(err.Error())
 	}
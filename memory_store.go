@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// MemoryStore is a Storage that keeps everything in memory. It is meant for
+// tests and local development; nothing survives a restart.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	users     []*User
+	messages  []*templates.Message
+	reactions []memoryReaction
+	// markers maps a username and conversation to the last message read there.
+	markers map[[2]string]int
+	nextId  int
+}
+
+type memoryReaction struct {
+	messageID int
+	username  string
+	emoji     string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{markers: make(map[[2]string]int)}
+}
+
+func (s *MemoryStore) Init() error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) CreateUser(usr *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Username == usr.Username {
+			return fmt.Errorf("failed to create user")
+		}
+	}
+	usr.Id = len(s.users) + 1
+	stored := *usr
+	if stored.Role == "" {
+		stored.Role = RoleUser
+	}
+	s.users = append(s.users, &stored)
+	return nil
+}
+
+func (s *MemoryStore) SetUserRole(username, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Username == username {
+			u.Role = role
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to set user role: no user %q", username)
+}
+
+func (s *MemoryStore) GetUser(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if u.Username == username {
+			usr := *u
+			return &usr, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get user")
+}
+
+func (s *MemoryStore) GetUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usrs := []*User{}
+	for _, u := range s.users {
+		usrs = append(usrs, &User{Id: u.Id, Username: u.Username})
+	}
+	return usrs, nil
+}
+
+func (s *MemoryStore) StoreMessage(msg *templates.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextId++
+	msg.Id = s.nextId
+	stored := *msg
+	s.messages = append(s.messages, &stored)
+	return nil
+}
+
+func (s *MemoryStore) ReserveMessageIDs(n int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int, n)
+	for i := range ids {
+		s.nextId++
+		ids[i] = s.nextId
+	}
+	return ids, nil
+}
+
+// StoreMessages keeps messages sorted by id, since reserved ids can be stored
+// after later ones.
+func (s *MemoryStore) StoreMessages(msgs []*templates.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		i, ok := slices.BinarySearchFunc(s.messages, msg.Id, func(m *templates.Message, id int) int { return m.Id - id })
+		if ok {
+			continue
+		}
+		stored := *msg
+		s.messages = slices.Insert(s.messages, i, &stored)
+	}
+	return nil
+}
+
+// message finds a stored message by id. Callers must hold the lock.
+func (s *MemoryStore) message(id int) *templates.Message {
+	i, ok := slices.BinarySearchFunc(s.messages, id, func(m *templates.Message, id int) int { return m.Id - id })
+	if !ok {
+		return nil
+	}
+	return s.messages[i]
+}
+
+func (s *MemoryStore) GetMessage(id int) (*templates.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msg := s.message(id)
+	if msg == nil {
+		return nil, fmt.Errorf("failed to get message")
+	}
+	return s.copyMessage(msg), nil
+}
+
+func (s *MemoryStore) UpdateMessage(id int, payload string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.message(id)
+	if msg == nil || msg.Deleted {
+		return fmt.Errorf("failed to update message: no message %d", id)
+	}
+	msg.Payload = payload
+	msg.Edited = true
+	return nil
+}
+
+func (s *MemoryStore) DeleteMessage(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := s.message(id)
+	if msg == nil {
+		return fmt.Errorf("failed to delete message: no message %d", id)
+	}
+	msg.Payload = ""
+	msg.Deleted = true
+	s.reactions = slices.DeleteFunc(s.reactions, func(r memoryReaction) bool { return r.messageID == id })
+	return nil
+}
+
+func (s *MemoryStore) ToggleReaction(messageID int, username, emoji string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.message(messageID) == nil {
+		return false, fmt.Errorf("failed to toggle reaction: no message %d", messageID)
+	}
+	r := memoryReaction{messageID, username, emoji}
+	if i := slices.Index(s.reactions, r); i >= 0 {
+		s.reactions = slices.Delete(s.reactions, i, i+1)
+		return false, nil
+	}
+	s.reactions = append(s.reactions, r)
+	return true, nil
+}
+
+// GetMessages returns one page of room messages matching q, oldest first.
+func (s *MemoryStore) GetMessages(q *MessageQuery) ([]*templates.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messages := []*templates.Message{}
+	if q.forward() {
+		for i := 0; i < len(s.messages) && len(messages) < q.PageSize(); i++ {
+			if q.matches(s.messages[i]) {
+				messages = append(messages, s.copyMessage(s.messages[i]))
+			}
+		}
+		return messages, nil
+	}
+	for i := len(s.messages) - 1; i >= 0 && len(messages) < q.PageSize(); i-- {
+		if q.matches(s.messages[i]) {
+			messages = append(messages, s.copyMessage(s.messages[i]))
+		}
+	}
+	slices.Reverse(messages)
+	return messages, nil
+}
+
+// GetThread returns the replies to the message parentID, oldest first.
+func (s *MemoryStore) GetThread(parentID int) ([]*templates.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messages := []*templates.Message{}
+	for _, msg := range s.messages {
+		if msg.ParentId == parentID {
+			messages = append(messages, s.copyMessage(msg))
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) MarkRead(username, conversation string, messageID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]string{username, conversation}
+	previous := s.markers[key]
+	if messageID > previous {
+		s.markers[key] = messageID
+	}
+	return previous, nil
+}
+
+func (s *MemoryStore) GetReadMarkers(conversation string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	markers := make(map[string]int)
+	for key, id := range s.markers {
+		if key[1] == conversation {
+			markers[key[0]] = id
+		}
+	}
+	return markers, nil
+}
+
+func (s *MemoryStore) GetUnreadCounts(username string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[string]int)
+	for key := range s.markers {
+		if key[0] == username && !strings.HasPrefix(key[1], "@") {
+			counts[key[1]] = 0
+		}
+	}
+	for _, msg := range s.messages {
+		switch {
+		case msg.Recipient == username:
+			conversation := "@" + msg.Sender
+			if msg.Id > s.markers[[2]string{username, conversation}] {
+				counts[conversation]++
+			}
+		case msg.Recipient == "" && msg.ParentId == 0 && msg.Sender != username:
+			marker, ok := s.markers[[2]string{username, msg.Room}]
+			if ok && msg.Id > marker {
+				counts[msg.Room]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// GetConversation returns the direct messages exchanged between users a and b, oldest first.
+func (s *MemoryStore) GetConversation(a, b string) ([]*templates.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messages := []*templates.Message{}
+	for _, msg := range s.messages {
+		if (msg.Sender == a && msg.Recipient == b) || (msg.Sender == b && msg.Recipient == a) {
+			messages = append(messages, s.copyMessage(msg))
+		}
+	}
+	return messages, nil
+}
+
+// GetInbox returns the latest direct message of every conversation username is part of, newest first.
+func (s *MemoryStore) GetInbox(username string) ([]*templates.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := make(map[string]bool)
+	messages := []*templates.Message{}
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		msg := s.messages[i]
+		if msg.Recipient == "" || (msg.Sender != username && msg.Recipient != username) {
+			continue
+		}
+		partner := msg.Sender
+		if partner == username {
+			partner = msg.Recipient
+		}
+		if !seen[partner] {
+			seen[partner] = true
+			messages = append(messages, s.copyMessage(msg))
+		}
+	}
+	slices.SortStableFunc(messages, func(a, b *templates.Message) int { return b.Datetime.Compare(a.Datetime) })
+	return messages, nil
+}
+
+// copyMessage copies a stored message along with its reactions and reply count.
+// Callers must hold the lock.
+func (s *MemoryStore) copyMessage(msg *templates.Message) *templates.Message {
+	cp := *msg
+	for _, m := range s.messages {
+		if m.ParentId == msg.Id {
+			cp.Replies++
+		}
+	}
+	for _, r := range s.reactions {
+		if r.messageID == msg.Id {
+			addReaction(&cp, r.username, r.emoji)
+		}
+	}
+	return &cp
+}
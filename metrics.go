@@ -0,0 +1,59 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"os"
+)
+
+// metrics holds mchat's counters. They are served as JSON, along with Go's
+// runtime stats, at /debug/vars on the admin listener.
+//
+//	send_queue_dropped      frames thrown away because a client's queue was full
+//	send_queue_coalesced    queued frames replaced by a newer one carrying the same state
+//	send_queue_disconnects  clients dropped because their queue was full
+//	persist_queue_length    messages waiting to be stored
+//	persist_queue_full      messages refused because that queue was full or no ids were ready
+//	persist_stored          messages stored
+//	persist_retries         batches retried after a transient database error
+//	persist_failed          messages that could not be stored
+//	connections_reaped      connections dropped because the peer stopped responding
+//	broker_dropped          events not shared with other servers because a queue was full
+//	rate_limited            messages, connections and logins refused by a rate limit
+//	bans                    users and IPs temporarily banned for flooding
+var metrics = expvar.NewMap("mchat")
+
+func init() {
+	for _, name := range []string{"send_queue_dropped", "send_queue_coalesced", "send_queue_disconnects",
+		"persist_queue_full", "persist_stored", "persist_retries", "persist_failed",
+		"connections_reaped", "broker_dropped", "rate_limited", "bans"} {
+		metrics.Add(name, 0)
+	}
+}
+
+// DefaultAdminAddr is where the admin listener serves /debug/vars unless
+// ADMIN_ADDR says otherwise. The runtime stats include the command line and
+// memory use, so by default only localhost can reach it.
+const DefaultAdminAddr = "127.0.0.1:6060"
+
+// serveAdmin starts the admin listener, unless ADMIN_ADDR is "off", and
+// returns its server so it can be closed on shutdown.
+func (s *ClientServer) serveAdmin() *http.Server {
+	addr := os.Getenv("ADMIN_ADDR")
+	switch addr {
+	case "off":
+		return nil
+	case "":
+		addr = DefaultAdminAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		s.logger.Printf("admin listener is live on: %s\n", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.Printf("admin listener error: %s", err)
+		}
+	}()
+	return srv
+}
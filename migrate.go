@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in migrations/<dialect>/NNNN_name.{up,down}.sql and are
+// applied in version order. Never edit a migration that has shipped; add a new one.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads the embedded migrations for dialect ("postgres" or "sqlite").
+func loadMigrations(dialect string) ([]*Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %s", dialect, err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		num, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("bad migration file name: %s", entry.Name())
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	slices.SortFunc(migrations, func(a, b *Migration) int { return a.Version - b.Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migrations must be numbered 1, 2, 3...; found %04d after %d", m.Version, i)
+		}
+	}
+	return migrations, nil
+}
+
+// migrationLockKey names the Postgres advisory lock migrations hold, so servers
+// starting together don't apply the same migration twice.
+const migrationLockKey = 0x6d63686174
+
+// Migrator moves a database between schema versions, tracked in the schema_version table.
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []*Migration
+}
+
+func NewMigrator(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	createVersionTableQuery := `CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+  )`
+	if _, err := db.Exec(createVersionTableQuery); err != nil {
+		return nil, fmt.Errorf("schema_version table init error: %s", err)
+	}
+	return m, nil
+}
+
+// lock keeps other servers from migrating until unlock is called. Postgres
+// holds an advisory lock on a connection of its own; SQLite databases are only
+// opened by one server, so there is nothing to do.
+func (m *Migrator) lock() (unlock func(), err error) {
+	if m.dialect != "postgres" {
+		return func() {}, nil
+	}
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migration lock error: %s", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("migration lock error: %s", err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			log.Printf("migration unlock error: %s", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// Latest is the schema version this binary was built for.
+func (m *Migrator) Latest() int {
+	return len(m.migrations)
+}
+
+// Version is the schema version the database is at.
+func (m *Migrator) Version() (int, error) {
+	var version int
+	row := m.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`)
+	if err := row.Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %s", err)
+	}
+	return version, nil
+}
+
+// Check refuses to continue if the database has migrations this binary doesn't know about,
+// which happens when an older binary is started against a newer database.
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version > m.Latest() {
+		return fmt.Errorf("database schema is at version %d but this binary only knows up to %d; upgrade mchat or roll back with the newer binary's migrate down", version, m.Latest())
+	}
+	return nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down rolls back the last steps migrations.
+func (m *Migrator) Down(steps int) error {
+	if steps < 0 {
+		return fmt.Errorf("can't roll back %d migrations", steps)
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	return m.migrate(max(version-steps, 0))
+}
+
+// To migrates up or down until the database is at target.
+func (m *Migrator) To(target int) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.migrate(target)
+}
+
+// migrate moves the database to target. The caller holds the migration lock.
+func (m *Migrator) migrate(target int) error {
+	if target < 0 || target > m.Latest() {
+		return fmt.Errorf("unknown schema version %d (latest is %d)", target, m.Latest())
+	}
+	if err := m.Check(); err != nil {
+		return err
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	for ; version < target; version++ {
+		mig := m.migrations[version]
+		if err := m.apply(mig.Up, `INSERT INTO schema_version (version, name) VALUES ($1, $2)`, mig.Version, mig.Name); err != nil {
+			return fmt.Errorf("migration %04d_%s up failed: %s", mig.Version, mig.Name, err)
+		}
+		log.Printf("applied migration %04d_%s", mig.Version, mig.Name)
+	}
+	for ; version > target; version-- {
+		mig := m.migrations[version-1]
+		if err := m.apply(mig.Down, `DELETE FROM schema_version WHERE version=$1`, mig.Version); err != nil {
+			return fmt.Errorf("migration %04d_%s down failed: %s", mig.Version, mig.Name, err)
+		}
+		log.Printf("rolled back migration %04d_%s", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+// apply runs a migration script and its schema_version bookkeeping in one transaction.
+func (m *Migrator) apply(script, bookkeeping string, args ...any) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(bookkeeping, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Migratable is implemented by stores with a SQL schema.
+type Migratable interface {
+	Migrator() (*Migrator, error)
+}
+
+// runMigrate implements the "mchat migrate" subcommand:
+//
+//	mchat migrate [up]      apply every pending migration
+//	mchat migrate down [n]  roll back the last n migrations (default 1)
+//	mchat migrate to <v>    migrate up or down to version v
+//	mchat migrate status    print the current and latest versions
+func runMigrate(store Storage, args []string) error {
+	migratable, ok := store.(Migratable)
+	if !ok {
+		return fmt.Errorf("this storage backend has no schema to migrate")
+	}
+	m, err := migratable.Migrator()
+	if err != nil {
+		return err
+	}
+	cmd := "up"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	number := func(fallback int) (int, error) {
+		if len(args) == 0 {
+			return fallback, nil
+		}
+		return strconv.Atoi(args[0])
+	}
+	switch cmd {
+	case "up":
+		err = m.Up()
+	case "down":
+		var steps int
+		if steps, err = number(1); err == nil {
+			err = m.Down(steps)
+		}
+	case "to":
+		var target int
+		if target, err = number(-1); err == nil {
+			err = m.To(target)
+		}
+	case "status":
+	default:
+		return fmt.Errorf("unknown migrate command %q (want up, down, to or status)", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d (latest %d)\n", version, m.Latest())
+	return nil
+}
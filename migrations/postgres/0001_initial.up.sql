@@ -0,0 +1,19 @@
+-- Databases created before migrations existed already have these tables,
+-- so this migration adopts them rather than failing.
+CREATE TABLE IF NOT EXISTS users (
+  id SERIAL NOT NULL PRIMARY KEY,
+  username VARCHAR(50) UNIQUE NOT NULL,
+  pass TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+  id SERIAL PRIMARY KEY,
+  payload TEXT NOT NULL,
+  sender TEXT NOT NULL,
+  recipient TEXT,
+  datetime TIMESTAMP DEFAULT NOW()
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS room TEXT NOT NULL DEFAULT 'lobby';
+
+CREATE INDEX IF NOT EXISTS messages_room_id_idx ON messages (room, id);
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN role;
+ALTER TABLE messages DROP COLUMN deleted;
+ALTER TABLE messages DROP COLUMN edited_at;
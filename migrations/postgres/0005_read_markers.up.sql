@@ -0,0 +1,7 @@
+-- conversation is a room name, or "@" and the other user for direct messages.
+CREATE TABLE read_markers (
+  username TEXT NOT NULL,
+  conversation TEXT NOT NULL,
+  message_id INTEGER NOT NULL,
+  PRIMARY KEY (username, conversation)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN edited_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
@@ -0,0 +1,7 @@
+CREATE TABLE reactions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+  username TEXT NOT NULL,
+  emoji TEXT NOT NULL,
+  UNIQUE (message_id, username, emoji)
+);
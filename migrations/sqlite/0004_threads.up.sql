@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN parent_id INTEGER REFERENCES messages(id);
+
+CREATE INDEX messages_parent_id_idx ON messages (parent_id);
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"sync"
+)
+
+// Overflow policies for a client's outbound queue, chosen with SEND_QUEUE_POLICY.
+const (
+	// PolicyDropOldest throws away the oldest queued frame to make room.
+	PolicyDropOldest = "drop-oldest"
+	// PolicyDisconnect drops the client; it can reconnect and catch up from history.
+	PolicyDisconnect = "disconnect"
+	// PolicyCoalesce replaces a queued frame that the new one supersedes (an
+	// older presence list, unread count, ...) and otherwise drops the oldest.
+	PolicyCoalesce = "coalesce"
+)
+
+// DefaultSendQueueSize is how many frames can wait for a slow client. SEND_QUEUE_SIZE overrides it.
+const DefaultSendQueueSize = 64
+
+// OutboxConfig sizes every client's outbound queue and says what to do when one fills up.
+type OutboxConfig struct {
+	Size   int
+	Policy string
+}
+
+// OutboxConfigFromEnv reads the queue size and overflow policy from the environment.
+func OutboxConfigFromEnv() OutboxConfig {
+	cfg := OutboxConfig{
+		Size:   max(envInt("SEND_QUEUE_SIZE", DefaultSendQueueSize), 1),
+		Policy: PolicyCoalesce,
+	}
+	switch policy := os.Getenv("SEND_QUEUE_POLICY"); policy {
+	case PolicyDropOldest, PolicyDisconnect, PolicyCoalesce:
+		cfg.Policy = policy
+	}
+	return cfg
+}
+
+// queued is an encoded frame waiting to be written.
+type queued struct {
+	key  string
+	data []byte
+}
+
+// outbox is a client's bounded outbound queue. The manager pushes to it without
+// ever blocking, and the client's write goroutine drains it.
+type outbox struct {
+	cfg    OutboxConfig
+	mu     sync.Mutex
+	ready  *sync.Cond
+	frames []queued
+	closed bool
+	// draining is set once the outbox takes no more frames and should close
+	// when the ones queued have been written, with the close frame closeMsg.
+	draining bool
+	closeMsg []byte
+}
+
+func newOutbox(cfg OutboxConfig) *outbox {
+	o := &outbox{cfg: cfg}
+	o.ready = sync.NewCond(&o.mu)
+	return o
+}
+
+// push queues data, applying the overflow policy if the queue is full. key
+// names the state a frame carries, if any; see frame.key. It reports false if
+// the client should be disconnected.
+func (o *outbox) push(key string, data []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.draining {
+		return false
+	}
+	if len(o.frames) >= o.cfg.Size {
+		switch o.cfg.Policy {
+		case PolicyDisconnect:
+			metrics.Add("send_queue_disconnects", 1)
+			return false
+		case PolicyCoalesce:
+			if i := o.superseded(key); i >= 0 {
+				o.frames[i].data = data
+				metrics.Add("send_queue_coalesced", 1)
+				return true
+			}
+			fallthrough
+		default:
+			o.frames = slices.Delete(o.frames, 0, 1)
+			metrics.Add("send_queue_dropped", 1)
+		}
+	}
+	o.frames = append(o.frames, queued{key: key, data: data})
+	o.ready.Signal()
+	return true
+}
+
+// superseded returns the index of the queued frame with the given key, or -1.
+// Callers must hold the lock.
+func (o *outbox) superseded(key string) int {
+	if key == "" {
+		return -1
+	}
+	return slices.IndexFunc(o.frames, func(q queued) bool { return q.key == key })
+}
+
+// next waits for the next frame to write. It returns false once the outbox is
+// closed, or drained.
+func (o *outbox) next() ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for len(o.frames) == 0 && !o.closed && !o.draining {
+		o.ready.Wait()
+	}
+	if o.closed || len(o.frames) == 0 {
+		return nil, false
+	}
+	data := o.frames[0].data
+	o.frames = slices.Delete(o.frames, 0, 1)
+	return data, true
+}
+
+// drain stops the outbox taking frames; the write goroutine stops once it has
+// written the ones already queued, and closes the connection with closeMsg.
+// Only the first drain picks the close frame.
+func (o *outbox) drain(closeMsg []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.draining {
+		o.draining = true
+		o.closeMsg = closeMsg
+	}
+	o.ready.Broadcast()
+}
+
+// drained reports whether the outbox stopped because of drain rather than
+// close, and if so returns the close frame to end the connection with.
+func (o *outbox) drained() ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closeMsg, o.draining && !o.closed
+}
+
+// close stops the write goroutine and discards anything still queued.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.frames = nil
+	o.ready.Broadcast()
+}
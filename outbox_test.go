@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOutboxOverflow(t *testing.T) {
+	type push struct{ key, data string }
+	tests := []struct {
+		name   string
+		policy string
+		pushes []push
+		// ok is what the last push returns, and want what is left queued.
+		ok   bool
+		want []string
+	}{
+		{
+			name:   "room to spare",
+			policy: PolicyDisconnect,
+			pushes: []push{{"", "a"}, {"", "b"}},
+			ok:     true,
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "drop oldest",
+			policy: PolicyDropOldest,
+			pushes: []push{{"", "a"}, {"", "b"}, {"", "c"}},
+			ok:     true,
+			want:   []string{"b", "c"},
+		},
+		{
+			name:   "drop oldest ignores keys",
+			policy: PolicyDropOldest,
+			pushes: []push{{"", "a"}, {"presence", "b"}, {"presence", "c"}},
+			ok:     true,
+			want:   []string{"b", "c"},
+		},
+		{
+			name:   "disconnect",
+			policy: PolicyDisconnect,
+			pushes: []push{{"", "a"}, {"", "b"}, {"", "c"}},
+			ok:     false,
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "coalesce replaces the superseded frame in place",
+			policy: PolicyCoalesce,
+			pushes: []push{{"presence", "a"}, {"", "b"}, {"presence", "c"}},
+			ok:     true,
+			want:   []string{"c", "b"},
+		},
+		{
+			name:   "coalesce drops the oldest when nothing is superseded",
+			policy: PolicyCoalesce,
+			pushes: []push{{"presence", "a"}, {"", "b"}, {"unread", "c"}},
+			ok:     true,
+			want:   []string{"b", "c"},
+		},
+		{
+			name:   "coalesce only when full",
+			policy: PolicyCoalesce,
+			pushes: []push{{"presence", "a"}, {"presence", "b"}},
+			ok:     true,
+			want:   []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOutbox(OutboxConfig{Size: 2, Policy: tt.policy})
+			var ok bool
+			for _, p := range tt.pushes {
+				ok = o.push(p.key, []byte(p.data))
+			}
+			if ok != tt.ok {
+				t.Errorf("last push = %v, want %v", ok, tt.ok)
+			}
+			got := []string{}
+			for _, q := range o.frames {
+				got = append(got, string(q.data))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("queued %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxDrainAndClose(t *testing.T) {
+	o := newOutbox(OutboxConfig{Size: 4, Policy: PolicyDropOldest})
+	o.push("", []byte("a"))
+	o.drain([]byte("bye"))
+	if o.push("", []byte("b")) {
+		t.Errorf("a draining outbox took a frame")
+	}
+	if data, ok := o.next(); !ok || string(data) != "a" {
+		t.Errorf("next = %q, %v, want the frame queued before draining", data, ok)
+	}
+	if _, ok := o.next(); ok {
+		t.Errorf("a drained outbox should stop the write goroutine")
+	}
+	if closeMsg, ok := o.drained(); !ok || string(closeMsg) != "bye" {
+		t.Errorf("drained = %q, %v, want the close frame it was drained with", closeMsg, ok)
+	}
+
+	o = newOutbox(OutboxConfig{Size: 4, Policy: PolicyDropOldest})
+	o.push("", []byte("a"))
+	o.close()
+	if _, drained := o.drained(); drained {
+		t.Errorf("a closed outbox should not count as drained")
+	}
+	if _, ok := o.next(); ok {
+		t.Errorf("a closed outbox should discard its frames and not count as drained")
+	}
+}
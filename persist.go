@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// Defaults for the persistence pipeline. PERSIST_QUEUE_SIZE, PERSIST_BATCH_SIZE
+// and PERSIST_FLUSH_INTERVAL override them.
+const (
+	DefaultPersistQueueSize     = 1024
+	DefaultPersistBatchSize     = 100
+	DefaultPersistFlushInterval = 50 * time.Millisecond
+)
+
+// Retries of transient database errors back off exponentially between these.
+const (
+	persistMinBackoff = 100 * time.Millisecond
+	persistMaxBackoff = 5 * time.Second
+)
+
+// PersistConfig sizes the queue of messages waiting to be stored and how they are batched.
+type PersistConfig struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	// ReserveEach reserves each message's id as it is sent rather than a
+	// batch ahead of need. Servers sharing a database use it so ids follow
+	// the order messages are sent in across all of them.
+	ReserveEach bool
+}
+
+// PersistConfigFromEnv reads the persistence settings from the environment.
+func PersistConfigFromEnv() PersistConfig {
+	return PersistConfig{
+		QueueSize:     max(envInt("PERSIST_QUEUE_SIZE", DefaultPersistQueueSize), 1),
+		BatchSize:     max(envInt("PERSIST_BATCH_SIZE", DefaultPersistBatchSize), 1),
+		FlushInterval: envDuration("PERSIST_FLUSH_INTERVAL", DefaultPersistFlushInterval),
+	}
+}
+
+// errPersistBusy refuses a message when the database has fallen too far behind.
+var errPersistBusy = errors.New("The server is too busy to take messages right now. Try again in a moment.")
+
+// persister stores chat messages in the background, so the manager never waits
+// on the database to deliver them. Messages get their ids up front from a
+// reserved block, go out with them straight away, and are written in batches.
+type persister struct {
+	store Storage
+	cfg   PersistConfig
+	queue chan *templates.Message
+	// ids holds a block of reserved ids ready to be handed out. prefetch
+	// refills it in the background until quit is closed.
+	ids  chan int
+	quit chan struct{}
+	// pending holds every message handed out an id but not yet stored.
+	mu      sync.Mutex
+	pending map[int]*pendingMessage
+	// stored is called on the persister goroutine with every batch once it is stored.
+	stored func([]*templates.Message)
+	// abort is closed when a shutdown runs out of time; done once the queue is drained.
+	abort  chan struct{}
+	done   chan struct{}
+	logger *log.Logger
+}
+
+// pendingMessage is a message waiting to be stored. settled is closed once it
+// has been stored or given up on.
+type pendingMessage struct {
+	msg     *templates.Message
+	settled chan struct{}
+}
+
+func newPersister(store Storage, cfg PersistConfig) *persister {
+	p := &persister{
+		store:   store,
+		cfg:     cfg,
+		queue:   make(chan *templates.Message, cfg.QueueSize),
+		ids:     make(chan int, cfg.BatchSize),
+		quit:    make(chan struct{}),
+		pending: make(map[int]*pendingMessage),
+		stored:  func([]*templates.Message) {},
+		abort:   make(chan struct{}),
+		done:    make(chan struct{}),
+		logger:  log.New(os.Stdout, "[persister] ", log.LstdFlags),
+	}
+	metrics.Set("persist_queue_length", expvar.Func(func() any { return len(p.queue) }))
+	return p
+}
+
+// reserve gives msg its id as it is sent, when ids aren't reserved ahead. It
+// is called from the sender's goroutine, and retries transient errors a few times.
+func (p *persister) reserve(msg *templates.Message) error {
+	if !p.cfg.ReserveEach {
+		return nil
+	}
+	backoff := persistMinBackoff
+	for attempt := 1; ; attempt++ {
+		ids, err := p.store.ReserveMessageIDs(1)
+		if err == nil {
+			msg.Id = ids[0]
+			return nil
+		}
+		if !transient(err) || attempt == reserveAttempts {
+			return fmt.Errorf("failed to reserve message id: %s", err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// reserveAttempts is how many times reserve tries before giving up.
+const reserveAttempts = 3
+
+// accept gives msg the next reserved id, unless reserve already gave it one,
+// and queues it to be stored. It never blocks: if no ids are ready or the
+// queue is full, because the database is down or has fallen behind, the
+// message is refused with errPersistBusy.
+func (p *persister) accept(msg *templates.Message) error {
+	if msg.Id == 0 {
+		select {
+		case msg.Id = <-p.ids:
+		default:
+			metrics.Add("persist_queue_full", 1)
+			return errPersistBusy
+		}
+	}
+	p.mu.Lock()
+	p.pending[msg.Id] = &pendingMessage{msg: msg, settled: make(chan struct{})}
+	p.mu.Unlock()
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+		p.settle([]*templates.Message{msg})
+		metrics.Add("persist_queue_full", 1)
+		return errPersistBusy
+	}
+}
+
+// prefetch keeps a block of ids ready for accept. Once a block is queued it
+// reserves the next, so that one is ready by the time the first runs out.
+func (p *persister) prefetch() {
+	backoff := persistMinBackoff
+	for {
+		ids, err := p.store.ReserveMessageIDs(p.cfg.BatchSize)
+		if err != nil {
+			p.logger.Printf("error reserving message ids, retrying in %s: %s", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-p.quit:
+				return
+			}
+			backoff = min(2*backoff, persistMaxBackoff)
+			continue
+		}
+		backoff = persistMinBackoff
+		for _, id := range ids {
+			select {
+			case p.ids <- id:
+			case <-p.quit:
+				return
+			}
+		}
+	}
+}
+
+// await waits until the message with the given id is no longer waiting to be stored.
+func (p *persister) await(id int) {
+	p.mu.Lock()
+	pending := p.pending[id]
+	p.mu.Unlock()
+	if pending != nil {
+		<-pending.settled
+	}
+}
+
+// unstored returns the messages newer than after that have not been stored yet, in no particular order.
+func (p *persister) unstored(after int) []*templates.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	messages := []*templates.Message{}
+	for id, pending := range p.pending {
+		if id > after {
+			messages = append(messages, pending.msg)
+		}
+	}
+	return messages
+}
+
+// withUnstored runs load to read messages from the database, and adds the
+// messages keep accepts that are still waiting to be stored, sorted by id. The
+// waiting messages are listed before load runs, so one stored in between is
+// still found by load. They are copies, so callers may annotate them.
+func (p *persister) withUnstored(load func() ([]*templates.Message, error), keep func(*templates.Message) bool) ([]*templates.Message, error) {
+	unstored := p.unstored(0)
+	messages, err := load()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range unstored {
+		if keep(msg) && !slices.ContainsFunc(messages, func(m *templates.Message) bool { return m.Id == msg.Id }) {
+			msg := *msg
+			messages = append(messages, &msg)
+		}
+	}
+	slices.SortFunc(messages, func(a, b *templates.Message) int { return a.Id - b.Id })
+	return messages, nil
+}
+
+// settle releases anyone waiting on batch.
+func (p *persister) settle(batch []*templates.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, msg := range batch {
+		if pending, ok := p.pending[msg.Id]; ok {
+			close(pending.settled)
+			delete(p.pending, msg.Id)
+		}
+	}
+}
+
+// run stores queued messages until the queue is closed and drained.
+func (p *persister) run() {
+	defer close(p.done)
+	if !p.cfg.ReserveEach {
+		go p.prefetch()
+	}
+	ticker := time.NewTicker(p.cfg.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*templates.Message, 0, p.cfg.BatchSize)
+	for {
+		select {
+		case msg, ok := <-p.queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) < p.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		p.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush stores batch. If the batch is refused outright, its messages are
+// stored one by one so a single bad message doesn't lose the rest.
+func (p *persister) flush(batch []*templates.Message) {
+	if len(batch) == 0 {
+		return
+	}
+	defer p.settle(batch)
+	err := p.retry(batch)
+	if err != nil && len(batch) > 1 {
+		p.logger.Printf("error storing %d messages, storing them one at a time: %s", len(batch), err)
+		stored := []*templates.Message{}
+		for _, msg := range batch {
+			if err := p.retry([]*templates.Message{msg}); err != nil {
+				metrics.Add("persist_failed", 1)
+				p.logger.Printf("error storing message %d: %s", msg.Id, err)
+				continue
+			}
+			stored = append(stored, msg)
+		}
+		batch = stored
+	} else if err != nil {
+		metrics.Add("persist_failed", 1)
+		p.logger.Printf("error storing message %d: %s", batch[0].Id, err)
+		return
+	}
+	metrics.Add("persist_stored", int64(len(batch)))
+	p.stored(batch)
+}
+
+// retry stores batch, retrying with backoff for as long as the errors are
+// transient, or until a shutdown gives up on it.
+func (p *persister) retry(batch []*templates.Message) error {
+	backoff := persistMinBackoff
+	for {
+		err := p.store.StoreMessages(batch)
+		if err == nil || !transient(err) {
+			return err
+		}
+		metrics.Add("persist_retries", 1)
+		p.logger.Printf("error storing messages, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-p.abort:
+			return err
+		}
+		backoff = min(2*backoff, persistMaxBackoff)
+	}
+}
+
+// Close stops accepting messages and waits for those queued to be stored, or
+// for ctx to end. Nothing may be enqueued once Close is called.
+func (p *persister) Close(ctx context.Context) error {
+	close(p.quit)
+	close(p.queue)
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		close(p.abort)
+		<-p.done
+		return fmt.Errorf("gave up storing queued messages: %s", ctx.Err())
+	}
+}
+
+// persistedStore is the Storage the manager and its clients use. Looking up or
+// changing a message by id first waits for it to be stored, so it can be replied
+// to, edited, reacted to or marked read as soon as it has gone out.
+type persistedStore struct {
+	Storage
+	persist *persister
+}
+
+func (s persistedStore) GetMessage(id int) (*templates.Message, error) {
+	s.persist.await(id)
+	return s.Storage.GetMessage(id)
+}
+
+func (s persistedStore) UpdateMessage(id int, payload string) error {
+	s.persist.await(id)
+	return s.Storage.UpdateMessage(id, payload)
+}
+
+func (s persistedStore) DeleteMessage(id int) error {
+	s.persist.await(id)
+	return s.Storage.DeleteMessage(id)
+}
+
+func (s persistedStore) ToggleReaction(messageID int, username, emoji string) (bool, error) {
+	s.persist.await(messageID)
+	return s.Storage.ToggleReaction(messageID, username, emoji)
+}
+
+func (s persistedStore) MarkRead(username, conversation string, messageID int) (int, error) {
+	s.persist.await(messageID)
+	return s.Storage.MarkRead(username, conversation, messageID)
+}
+
+// transient reports whether err is worth retrying: a lost or refused
+// connection, a busy database, or a conflict with a concurrent transaction.
+func transient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// connection exception, transaction rollback, insufficient resources, operator intervention
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
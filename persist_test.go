@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// flakyStore is a MemoryStore whose StoreMessages fails however fail says.
+type flakyStore struct {
+	*MemoryStore
+	mu    sync.Mutex
+	calls int
+	// fail is called with each attempt to store a batch, counting from 1.
+	fail func(call int, batch []*templates.Message) error
+	// batches records the size of every batch stored.
+	batches []int
+}
+
+func (s *flakyStore) StoreMessages(batch []*templates.Message) error {
+	s.mu.Lock()
+	s.calls++
+	err := s.fail(s.calls, batch)
+	if err == nil {
+		s.batches = append(s.batches, len(batch))
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.MemoryStore.StoreMessages(batch)
+}
+
+// acceptAll hands every message to p, waiting for its first block of ids.
+func acceptAll(t *testing.T, p *persister, messages []*templates.Message) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for _, msg := range messages {
+		for {
+			err := p.accept(msg)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errPersistBusy) || time.Now().After(deadline) {
+				t.Fatalf("accept: %s", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func testMessages(payloads ...string) []*templates.Message {
+	messages := []*templates.Message{}
+	for _, payload := range payloads {
+		messages = append(messages, &templates.Message{Sender: "alice", Room: "lobby", Payload: payload, Datetime: time.Now()})
+	}
+	return messages
+}
+
+func TestPersister(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      PersistConfig
+		payloads []string
+		fail     func(call int, batch []*templates.Message) error
+		// wait is how long to leave the persister running before Close.
+		wait        time.Duration
+		wantBatches []int
+		wantStored  []string
+	}{
+		{
+			name:        "fills batches",
+			cfg:         PersistConfig{QueueSize: 16, BatchSize: 3, FlushInterval: time.Hour},
+			payloads:    []string{"a", "b", "c", "d", "e", "f", "g"},
+			wantBatches: []int{3, 3, 1},
+			wantStored:  []string{"a", "b", "c", "d", "e", "f", "g"},
+		},
+		{
+			name:        "flushes a partial batch on the interval",
+			cfg:         PersistConfig{QueueSize: 16, BatchSize: 100, FlushInterval: 10 * time.Millisecond},
+			payloads:    []string{"a", "b"},
+			wait:        100 * time.Millisecond,
+			wantBatches: []int{2},
+			wantStored:  []string{"a", "b"},
+		},
+		{
+			name:     "falls back to one at a time",
+			cfg:      PersistConfig{QueueSize: 16, BatchSize: 3, FlushInterval: time.Hour},
+			payloads: []string{"a", "bad", "c"},
+			fail: func(call int, batch []*templates.Message) error {
+				if slices.ContainsFunc(batch, func(m *templates.Message) bool { return m.Payload == "bad" }) {
+					return errors.New("value too long")
+				}
+				return nil
+			},
+			wantBatches: []int{1, 1},
+			wantStored:  []string{"a", "c"},
+		},
+		{
+			name:     "retries transient errors",
+			cfg:      PersistConfig{QueueSize: 16, BatchSize: 2, FlushInterval: time.Hour},
+			payloads: []string{"a", "b"},
+			fail: func(call int, batch []*templates.Message) error {
+				if call <= 2 {
+					return driver.ErrBadConn
+				}
+				return nil
+			},
+			wantBatches: []int{2},
+			wantStored:  []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyStore{MemoryStore: NewMemoryStore(), fail: tt.fail}
+			if store.fail == nil {
+				store.fail = func(int, []*templates.Message) error { return nil }
+			}
+			p := newPersister(store, tt.cfg)
+			go p.run()
+			messages := testMessages(tt.payloads...)
+			acceptAll(t, p, messages)
+			time.Sleep(tt.wait)
+			if err := p.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(store.batches, tt.wantBatches) {
+				t.Errorf("stored batches of %v, want %v", store.batches, tt.wantBatches)
+			}
+			stored, _ := store.GetMessages(&MessageQuery{Room: "lobby"})
+			got := []string{}
+			for _, msg := range stored {
+				got = append(got, msg.Payload)
+			}
+			if !slices.Equal(got, tt.wantStored) {
+				t.Errorf("stored %q, want %q", got, tt.wantStored)
+			}
+			if unstored := p.unstored(0); len(unstored) != 0 {
+				t.Errorf("%d messages still pending after Close", len(unstored))
+			}
+		})
+	}
+}
+
+func TestPersisterCloseGivesUp(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore(), fail: func(int, []*templates.Message) error { return driver.ErrBadConn }}
+	p := newPersister(store, PersistConfig{QueueSize: 16, BatchSize: 1, FlushInterval: time.Hour})
+	go p.run()
+	messages := testMessages("a")
+	acceptAll(t, p, messages)
+
+	awaited := make(chan struct{})
+	go func() {
+		p.await(messages[0].Id)
+		close(awaited)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Close(ctx); err == nil {
+		t.Errorf("Close succeeded with the database down")
+	}
+	select {
+	case <-awaited:
+	case <-time.After(time.Second):
+		t.Errorf("await still blocked after Close gave up")
+	}
+}
+
+func TestPersisterRefusesWhenFull(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore(), fail: func(int, []*templates.Message) error { return nil }}
+	p := newPersister(store, PersistConfig{QueueSize: 1, BatchSize: 4, FlushInterval: time.Hour})
+	// Only fetch ids; nothing drains the queue.
+	go p.prefetch()
+	defer close(p.quit)
+	acceptAll(t, p, testMessages("a"))
+	msg := testMessages("b")[0]
+	if err := p.accept(msg); !errors.Is(err, errPersistBusy) {
+		t.Fatalf("accept with a full queue = %v, want errPersistBusy", err)
+	}
+	if unstored := p.unstored(0); len(unstored) != 1 {
+		t.Errorf("%d messages pending, want only the one queued", len(unstored))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// brokerChannel is the Postgres notification channel servers talk on.
+const brokerChannel = "mchat_events"
+
+// maxChunk is how much of an event fits in one notification. Postgres caps
+// notification payloads at 8000 bytes, so bigger events go out in pieces.
+const maxChunk = 7900
+
+// PostgresBroker shares events between servers with Postgres LISTEN/NOTIFY.
+// Notifications aren't stored: a server that loses its connection misses what
+// is sent until it reconnects, and presence catches up at the next heartbeat.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	events   chan *Event
+	// partial holds the pieces of chunked events received so far. It is only
+	// used by the receive goroutine.
+	partial map[string]*chunkedEvent
+	logger  *log.Logger
+}
+
+// chunkedEvent is an event arriving in several notifications.
+type chunkedEvent struct {
+	chunks   []string
+	received int
+	started  time.Time
+}
+
+// NewPostgresBroker listens for events on the database at connStr.
+func NewPostgresBroker(connStr string) (*PostgresBroker, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	b := &PostgresBroker{
+		db:      db,
+		events:  make(chan *Event, 256),
+		partial: make(map[string]*chunkedEvent),
+		logger:  log.New(os.Stdout, "[broker] ", log.LstdFlags),
+	}
+	b.listener = pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			b.logger.Printf("listener error: %s", err)
+		}
+	})
+	if err := b.listener.Listen(brokerChannel); err != nil {
+		b.listener.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to listen for events: %s", err)
+	}
+	go b.receive()
+	return b, nil
+}
+
+// Publish notifies every listening server of event. The chunks of a large
+// event are sent in one transaction, so they arrive together and in order.
+func (b *PostgresBroker) Publish(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %s", err)
+	}
+	id := uuid.NewString()
+	chunks := chunk(string(data), maxChunk-len(id)-16)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %s", err)
+	}
+	defer tx.Rollback()
+	for i, c := range chunks {
+		payload := fmt.Sprintf("%s %d %d %s", id, i, len(chunks), c)
+		if _, err := tx.Exec(`SELECT pg_notify($1, $2)`, brokerChannel, payload); err != nil {
+			return fmt.Errorf("failed to publish event: %s", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to publish event: %s", err)
+	}
+	return nil
+}
+
+// chunk splits s into pieces of at most n bytes without splitting a UTF-8
+// character, since notification payloads must be valid text.
+func chunk(s string, n int) []string {
+	chunks := []string{}
+	for len(s) > n {
+		cut := n
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		chunks = append(chunks, s[:cut])
+		s = s[cut:]
+	}
+	return append(chunks, s)
+}
+
+// receive decodes notifications into events until the listener is closed.
+func (b *PostgresBroker) receive() {
+	defer close(b.events)
+	for n := range b.listener.Notify {
+		if n == nil {
+			// The listener reconnected; anything sent in between is lost.
+			b.logger.Println("reconnected to the database, events may have been missed")
+			continue
+		}
+		data, ok := b.assemble(n.Extra)
+		if !ok {
+			continue
+		}
+		event := new(Event)
+		if err := json.Unmarshal([]byte(data), event); err != nil {
+			b.logger.Printf("bad event: %s", err)
+			continue
+		}
+		b.events <- event
+	}
+}
+
+// assemble adds a notification to the event it is part of, returning the
+// event once every chunk has arrived.
+func (b *PostgresBroker) assemble(payload string) (string, bool) {
+	parts := strings.SplitN(payload, " ", 4)
+	if len(parts) != 4 {
+		b.logger.Printf("bad notification: %.40q", payload)
+		return "", false
+	}
+	id, data := parts[0], parts[3]
+	i, err1 := strconv.Atoi(parts[1])
+	count, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || count < 1 || i < 0 || i >= count {
+		b.logger.Printf("bad notification: %.40q", payload)
+		return "", false
+	}
+	if count == 1 {
+		return data, true
+	}
+	ev, ok := b.partial[id]
+	if !ok {
+		// Forget events whose other chunks never came.
+		for other, stale := range b.partial {
+			if time.Since(stale.started) > time.Minute {
+				delete(b.partial, other)
+			}
+		}
+		ev = &chunkedEvent{chunks: make([]string, count), started: time.Now()}
+		b.partial[id] = ev
+	}
+	if ev.chunks[i] == "" {
+		ev.chunks[i] = data
+		ev.received++
+	}
+	if ev.received < count {
+		return "", false
+	}
+	delete(b.partial, id)
+	return strings.Join(ev.chunks, ""), true
+}
+
+func (b *PostgresBroker) Events() <-chan *Event {
+	return b.events
+}
+
+func (b *PostgresBroker) Close() error {
+	if err := b.listener.Close(); err != nil {
+		return err
+	}
+	return b.db.Close()
+}
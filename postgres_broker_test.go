@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChunk(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want []string
+	}{
+		{"fits", "hello", 5, []string{"hello"}},
+		{"empty", "", 4, []string{""}},
+		{"splits evenly", "abcdef", 3, []string{"abc", "def"}},
+		{"leaves a short tail", "abcdefg", 3, []string{"abc", "def", "g"}},
+		{"keeps characters whole", "aé€b", 3, []string{"aé", "€", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunk(tt.s, tt.n)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("chunk(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+			}
+			if joined := strings.Join(got, ""); joined != tt.s {
+				t.Errorf("chunks join to %q, want %q", joined, tt.s)
+			}
+		})
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name          string
+		notifications []string
+		// want is the event assembled by the last notification, if any.
+		want string
+		ok   bool
+	}{
+		{"single", []string{"e1 0 1 {}"}, "{}", true},
+		{"in order", []string{"e1 0 2 hel", "e1 1 2 lo"}, "hello", true},
+		{"out of order", []string{"e1 1 2 lo", "e1 0 2 hel"}, "hello", true},
+		{"waits for every chunk", []string{"e1 0 3 a", "e1 2 3 c"}, "", false},
+		{"ignores repeats", []string{"e1 0 3 a", "e1 0 3 a", "e1 1 3 b"}, "", false},
+		{"keeps events apart", []string{"e1 0 2 a", "e2 0 2 x", "e1 1 2 b"}, "ab", true},
+		{"keeps spaces in data", []string{"e1 0 1 a b c"}, "a b c", true},
+		{"malformed", []string{"e1 0 1"}, "", false},
+		{"index out of range", []string{"e1 2 2 a"}, "", false},
+		{"bad count", []string{"e1 0 x a"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &PostgresBroker{partial: make(map[string]*chunkedEvent), logger: log.New(io.Discard, "", 0)}
+			var got string
+			var ok bool
+			for _, n := range tt.notifications {
+				got, ok = b.assemble(n)
+			}
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("assemble = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// DefaultAwayAfter is how long a user can go without sending anything before
+// they show as away. AWAY_AFTER overrides it.
+const DefaultAwayAfter = 5 * time.Minute
+
+// presenceInterval is how often the manager checks for users going idle, at most.
+const presenceInterval = 15 * time.Second
+
+func awayAfterFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("AWAY_AFTER")); err == nil && d > 0 {
+		return d
+	}
+	return DefaultAwayAfter
+}
+
+// touch marks the client as active now. It is called from the client's read goroutine.
+func (c *Client) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+// idle reports whether the client has been quiet for longer than d.
+func (c *Client) idle(now time.Time, d time.Duration) bool {
+	return now.Sub(time.Unix(0, c.active.Load())) > d
+}
+
+// away reports whether every client username has open is idle. A user is
+// online for as long as any of their tabs is active.
+func (manager *ClientManager) away(username string, now time.Time) bool {
+	for client := range manager.clients {
+		if client.username == username && !client.idle(now, manager.awayAfter) {
+			return false
+		}
+	}
+	return true
+}
+
+// presence lists everyone in room, here or on another server, sorted by name.
+// A user connected to several servers is only away if they are away on all of them.
+func (manager *ClientManager) presence(room *Room, now time.Time) []templates.Presence {
+	users := manager.localPresence(room, now)
+	for _, remote := range manager.remoteUsers(room.name) {
+		if i := slices.IndexFunc(users, func(p templates.Presence) bool { return p.Username == remote.Username }); i >= 0 {
+			users[i].Away = users[i].Away && remote.Away
+		} else {
+			users = append(users, remote)
+		}
+	}
+	slices.SortFunc(users, func(a, b templates.Presence) int { return strings.Compare(a.Username, b.Username) })
+	return users
+}
+
+// localPresence lists the users connected to this server in room, sorted by name.
+func (manager *ClientManager) localPresence(room *Room, now time.Time) []templates.Presence {
+	users := []templates.Presence{}
+	for client := range room.clients {
+		if !slices.ContainsFunc(users, func(p templates.Presence) bool { return p.Username == client.username }) {
+			users = append(users, templates.Presence{Username: client.username, Away: manager.away(client.username, now)})
+		}
+	}
+	slices.SortFunc(users, func(a, b templates.Presence) int { return strings.Compare(a.Username, b.Username) })
+	return users
+}
+
+// publishPresence sends room's online list to everyone in it.
+func (manager *ClientManager) publishPresence(room *Room) {
+	now := time.Now()
+	users := manager.presence(room, now)
+	f := newFrame(templates.WsOnlineList(users), protocol.TypePresence, &templates.Message{Room: room.name, Datetime: now})
+	f.envelope.ID = ""
+	f.key = "presence:" + room.name
+	for _, u := range users {
+		status := protocol.StatusOnline
+		if u.Away {
+			status = protocol.StatusAway
+		}
+		f.envelope.Users = append(f.envelope.Users, protocol.Presence{Username: u.Username, Status: status})
+	}
+	for client := range room.clients {
+		manager.deliver(client, f)
+	}
+}
+
+// announce sends a system message to everyone in room.
+func (manager *ClientManager) announce(room *Room, text string) {
+	msg := &templates.Message{Sender: SystemSender, Room: room.name, Payload: text, Datetime: time.Now()}
+	f := newFrame(templates.WsSystemMessage(text), protocol.TypeSystem, msg)
+	for client := range room.clients {
+		manager.deliver(client, f)
+	}
+}
+
+// announceEverywhere sends a system message to everyone in room, on every server.
+func (manager *ClientManager) announceEverywhere(room *Room, text string) {
+	manager.announce(room, text)
+	manager.publish(&Event{Kind: EventAnnounce, Room: room.name, Payload: text})
+}
+
+// arrived tells room that client joined, unless its user was already there in another tab.
+func (manager *ClientManager) arrived(room *Room, client *Client) {
+	if !manager.elsewhere(room, client) {
+		manager.announceEverywhere(room, fmt.Sprintf("%s joined #%s.", client.username, room.name))
+	}
+	manager.publishPresence(room)
+	manager.sharePresence()
+}
+
+// departed tells room that client left, unless its user is still there in another tab.
+func (manager *ClientManager) departed(room *Room, client *Client) {
+	if !manager.elsewhere(room, client) {
+		manager.announceEverywhere(room, fmt.Sprintf("%s left #%s.", client.username, room.name))
+	}
+	if !room.Empty() {
+		manager.publishPresence(room)
+	}
+	manager.sharePresence()
+}
+
+// elsewhere reports whether client's user is also in room in another tab, on
+// this server or another.
+func (manager *ClientManager) elsewhere(room *Room, client *Client) bool {
+	return inRoomExcept(room, client) || slices.ContainsFunc(manager.remoteUsers(room.name), func(p templates.Presence) bool {
+		return p.Username == client.username
+	})
+}
+
+// online reports whether username has any client connected.
+func (manager *ClientManager) online(username string) bool {
+	for client := range manager.clients {
+		if client.username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// inRoomExcept reports whether client's user has some other client in room.
+func inRoomExcept(room *Room, client *Client) bool {
+	for other := range room.clients {
+		if other != client && other.username == client.username {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIdle republishes the online list of every room where someone went
+// away or came back since the last check.
+func (manager *ClientManager) checkIdle() {
+	now := time.Now()
+	away := make(map[string]bool)
+	for client := range manager.clients {
+		if _, ok := away[client.username]; !ok {
+			away[client.username] = manager.away(client.username, now)
+		}
+	}
+	for _, room := range manager.rooms {
+		for client := range room.clients {
+			if away[client.username] != manager.wasAway[client.username] {
+				manager.publishPresence(room)
+				break
+			}
+		}
+	}
+	manager.wasAway = away
+}
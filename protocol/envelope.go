@@ -0,0 +1,101 @@
+// Package protocol defines the JSON wire format mchat speaks to non-browser clients.
+//
+// Browsers get htmx fragments over the websocket. Any other client can ask for
+// JSON envelopes instead, either by offering the Subprotocol in the
+// Sec-WebSocket-Protocol header or by adding ?format=json to the upgrade URL.
+package protocol
+
+import "time"
+
+// Version is the envelope version this server speaks.
+const Version = 1
+
+// Subprotocol is the websocket subprotocol that selects version 1 JSON envelopes.
+const Subprotocol = "mchat-v1.json"
+
+// Envelope types.
+const (
+	// TypeMessage is a chat message in a room.
+	TypeMessage = "message"
+	// TypeWhisper is a private message between two users.
+	TypeWhisper = "whisper"
+	// TypeSystem is a notice from the server to a single client.
+	TypeSystem = "system"
+	// TypeReply is the output of a slash command, sent to the caller only.
+	TypeReply = "reply"
+	// TypeEdit replaces the payload of the message with the same ID.
+	TypeEdit = "edit"
+	// TypeDelete removes the message with the same ID.
+	TypeDelete = "delete"
+	// TypeReact toggles the sender's Payload emoji on the message with the same ID.
+	// The server answers everyone who can see the message with the new Reactions.
+	TypeReact = "react"
+	// TypeThread opens the thread under the message with the same ID, or closes
+	// the open thread when ID is empty. Only clients with a thread open receive
+	// its replies, which are TypeMessage envelopes with Parent set. The server
+	// sends everyone else in the room a TypeThread envelope for the parent
+	// message whenever its Replies count changes.
+	TypeThread = "thread"
+	// TypePresence lists the Users in Room. The server sends one whenever someone
+	// joins, leaves, goes away or comes back.
+	TypePresence = "presence"
+	// TypeTyping says the sender is typing in their room. It is never stored;
+	// the indicator lasts a few seconds unless refreshed, and ends when the
+	// sender posts a message or leaves. The server answers with TypeTyping
+	// envelopes listing the other Users typing in the room.
+	TypeTyping = "typing"
+	// TypeRead says the sender has read up to the message with the same ID. With
+	// no ID it marks everything in the sender's room or conversation read. The
+	// server passes it on to everyone in the conversation as a receipt.
+	TypeRead = "read"
+	// TypeUnread carries the recipient's Unread counts. The server sends one
+	// when a client connects and whenever the counts change.
+	TypeUnread = "unread"
+	// TypeReload tells a reconnecting client it missed too many messages to be
+	// replayed, and should fetch Room's history afresh. Clients reconnect with
+	// the ID of the last message they saw in a since query parameter, and the
+	// server replays anything newer before resuming live delivery.
+	TypeReload = "reload"
+	// TypeJoin asks the server to move the client to Room.
+	TypeJoin = "join"
+	// TypeLeave asks the server to send the client back to the lobby.
+	TypeLeave = "leave"
+)
+
+// Envelope is a single JSON frame on the websocket. Stored messages carry their
+// database id in ID, which clients send back to edit or delete them.
+type Envelope struct {
+	Version   int       `json:"v"`
+	Type      string    `json:"type"`
+	ID        string    `json:"id,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	Sender    string    `json:"sender,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Payload   string    `json:"payload,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Parent is the ID of the message a reply belongs to.
+	Parent string `json:"parent,omitempty"`
+	// Replies counts the replies in a message's thread.
+	Replies int `json:"replies,omitempty"`
+	// Users is the online list of a TypePresence envelope.
+	Users []Presence `json:"users,omitempty"`
+	// Unread counts the unread messages in each room, and in each direct
+	// message conversation keyed by "@" and the other user.
+	Unread map[string]int `json:"unread,omitempty"`
+	// Reactions counts the reactions on a message by emoji.
+	Reactions map[string]int `json:"reactions,omitempty"`
+}
+
+// Presence statuses.
+const (
+	StatusOnline = "online"
+	StatusAway   = "away"
+	StatusTyping = "typing"
+)
+
+// Presence is one user in a room's online list. A user is online while any of
+// their connections is active and away once all of them have gone quiet.
+type Presence struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/muhreeowki/mchat/protocol"
+)
+
+// RateLimit is a token bucket: PerMinute tokens are added every minute, up to
+// Burst, and each action takes one.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// rateLimitFromEnv reads RATE_<NAME> (per minute) and RATE_<NAME>_BURST.
+func rateLimitFromEnv(name string, perMinute, burst int) RateLimit {
+	return RateLimit{
+		PerMinute: max(envInt("RATE_"+name, perMinute), 1),
+		Burst:     max(envInt("RATE_"+name+"_BURST", burst), 1),
+	}
+}
+
+// RateLimits says how fast clients may act, and when flooding earns a ban.
+type RateLimits struct {
+	// Messages limits what each user sends over its websockets, by permission.
+	// Guests are limited by IP, since they get a new name on every connection.
+	Messages map[Permission]RateLimit
+	// Reads limits how often each user opens threads and marks messages read,
+	// by permission. Both are sent as the user reads rather than types, so
+	// they get more room than Messages.
+	Reads map[Permission]RateLimit
+	// Connections limits websocket upgrades from each IP, by permission.
+	Connections map[Permission]RateLimit
+	// Logins limits login and signup attempts from each IP.
+	Logins RateLimit
+	// BanAfter violations within BanWindow ban the offender for BanDuration.
+	BanAfter    int
+	BanWindow   time.Duration
+	BanDuration time.Duration
+}
+
+// RateLimitsFromEnv reads the rate limits from the environment. Guests' message
+// limit defaults to GUEST_MESSAGES_PER_MINUTE.
+func RateLimitsFromEnv() *RateLimits {
+	guestMessages := envInt("GUEST_MESSAGES_PER_MINUTE", 10)
+	return &RateLimits{
+		Messages: map[Permission]RateLimit{
+			PermGuest:     rateLimitFromEnv("MESSAGES_GUEST", guestMessages, 5),
+			PermUser:      rateLimitFromEnv("MESSAGES_USER", 60, 10),
+			PermModerator: rateLimitFromEnv("MESSAGES_MODERATOR", 240, 30),
+		},
+		Reads: map[Permission]RateLimit{
+			PermGuest:     rateLimitFromEnv("READS_GUEST", 60, 20),
+			PermUser:      rateLimitFromEnv("READS_USER", 240, 60),
+			PermModerator: rateLimitFromEnv("READS_MODERATOR", 480, 120),
+		},
+		Connections: map[Permission]RateLimit{
+			PermGuest:     rateLimitFromEnv("CONNECTIONS_GUEST", 10, 5),
+			PermUser:      rateLimitFromEnv("CONNECTIONS_USER", 30, 10),
+			PermModerator: rateLimitFromEnv("CONNECTIONS_MODERATOR", 60, 20),
+		},
+		Logins:      rateLimitFromEnv("LOGINS", 5, 5),
+		BanAfter:    max(envInt("BAN_AFTER", 5), 1),
+		BanWindow:   envDuration("BAN_WINDOW", time.Minute),
+		BanDuration: envDuration("BAN_DURATION", 10*time.Minute),
+	}
+}
+
+// bucket is one token bucket's state.
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// full reports whether the bucket will have refilled by now.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Minutes()*float64(b.limit.PerMinute) >= float64(b.limit.Burst)
+}
+
+// offender counts the recent violations of a user or IP.
+type offender struct {
+	violations []time.Time
+	bannedTill time.Time
+}
+
+// limiterSweepInterval is how often refilled buckets and forgiven offenders are forgotten.
+const limiterSweepInterval = time.Minute
+
+// Limiter enforces RateLimits. Buckets are named by what they limit and who,
+// like "messages:user:alice"; bans are on the who part alone, like "ip:10.0.0.1",
+// so a ban earned flooding messages also refuses connections. It is safe for
+// concurrent use. Each server keeps its own counts.
+type Limiter struct {
+	limits    *RateLimits
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	offenders map[string]*offender
+	swept     time.Time
+	logger    *log.Logger
+}
+
+func NewLimiter(limits *RateLimits) *Limiter {
+	return &Limiter{
+		limits:    limits,
+		buckets:   make(map[string]*bucket),
+		offenders: make(map[string]*offender),
+		swept:     time.Now(),
+		logger:    log.New(os.Stdout, "[limiter] ", log.LstdFlags),
+	}
+}
+
+// throttle takes a token from who's bucket for what on behalf of an HTTP
+// request. If the request is refused it sets Retry-After, and returns the
+// status and error to answer it with.
+func (s *ClientServer) throttle(c *gin.Context, who, what string, limit RateLimit) (int, error) {
+	banned, err := s.limiter.Allow(who, what, limit)
+	switch {
+	case err == nil:
+		return http.StatusOK, nil
+	case banned:
+		retryAfter(c, s.limiter.BannedFor(who))
+		return http.StatusForbidden, err
+	default:
+		retryAfter(c, time.Minute/time.Duration(limit.PerMinute))
+		return http.StatusTooManyRequests, err
+	}
+}
+
+// retryAfter tells the client how long to wait before trying again.
+func retryAfter(c *gin.Context, d time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// throttle takes a token for in from the client's bucket for its kind, telling
+// the client if it is refused. A client that earns a ban is disconnected.
+//
+// Typing indicators and read receipts are sent by the client as things happen
+// rather than by the user, so they never earn a ban. Typing isn't counted, and
+// receipts over the limit are dropped without a word; the next one marks the
+// same messages read. Guests' receipts aren't kept, so they aren't counted either.
+func (c *Client) throttle(in *inboundMessage) bool {
+	who := userKey(c.username)
+	if c.guest != nil {
+		who = ipKey(c.ip)
+	}
+	reads := c.limiter.limits.Reads[c.Permission()]
+	switch in.kind() {
+	case protocol.TypeTyping:
+		return true
+	case protocol.TypeRead:
+		return c.guest != nil || c.limiter.Spare(who, "reads", reads) == nil
+	case protocol.TypeThread:
+		if err := c.limiter.Spare(who, "reads", reads); err != nil {
+			c.manager.notify(c, err.Error())
+			return false
+		}
+		return true
+	}
+	banned, err := c.limiter.Allow(who, "messages", c.limiter.limits.Messages[c.Permission()])
+	if err == nil {
+		return true
+	}
+	if banned {
+		c.disconnect(err.Error(), websocket.ClosePolicyViolation, "temporarily banned for flooding")
+		return false
+	}
+	c.manager.notify(c, err.Error())
+	return false
+}
+
+// userKey names a user for rate limiting and bans.
+func userKey(username string) string {
+	return "user:" + username
+}
+
+// ipKey names an IP address for rate limiting and bans.
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// trustedProxies reads TRUSTED_PROXIES, the comma separated IPs or CIDRs of
+// reverse proxies whose X-Forwarded-For header is believed. None are trusted by
+// default, so clients are known by the address they connect from and can't
+// dodge their limits by forging the header.
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// Allow takes a token from who's bucket for what, which holds limit. If who is
+// banned, or the bucket is empty, it returns an error to show them. Hitting a
+// limit counts towards a ban, and banned reports whether who is now banned.
+func (l *Limiter) Allow(who, what string, limit RateLimit) (banned bool, err error) {
+	return l.allow(who, what, limit, true)
+}
+
+// Spare is Allow for actions that don't deserve a ban, like read receipts,
+// which clients send on their own as messages arrive: an empty bucket refuses
+// the action but doesn't count against who.
+func (l *Limiter) Spare(who, what string, limit RateLimit) error {
+	_, err := l.allow(who, what, limit, false)
+	return err
+}
+
+func (l *Limiter) allow(who, what string, limit RateLimit, strict bool) (banned bool, err error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	if left := l.bannedFor(who, now); left > 0 {
+		return true, bannedError(left)
+	}
+	key := what + ":" + who
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	// The same bucket may be held to different limits, like the connections
+	// from an IP shared by guests and users. What is left carries over, so
+	// switching between them can't refill it.
+	b.limit = limit
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Minutes()*float64(limit.PerMinute))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return false, nil
+	}
+	metrics.Add("rate_limited", 1)
+	if strict && l.violation(who, now) {
+		return true, bannedError(l.limits.BanDuration)
+	}
+	return false, fmt.Errorf("Slow down! Only %d %s a minute are allowed.", limit.PerMinute, what)
+}
+
+// BannedFor returns how long is left of who's ban, or 0 if they aren't banned.
+func (l *Limiter) BannedFor(who string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bannedFor(who, time.Now())
+}
+
+func (l *Limiter) bannedFor(who string, now time.Time) time.Duration {
+	if o, ok := l.offenders[who]; ok && now.Before(o.bannedTill) {
+		return o.bannedTill.Sub(now)
+	}
+	return 0
+}
+
+// bannedError tells someone banned for left more time why they were refused.
+func bannedError(left time.Duration) error {
+	return fmt.Errorf("You are temporarily banned for flooding. Try again in %s.", left.Round(time.Second))
+}
+
+// violation records that who hit a limit, and bans them if they have done so
+// BanAfter times within BanWindow. It reports whether they were banned.
+func (l *Limiter) violation(who string, now time.Time) bool {
+	o, ok := l.offenders[who]
+	if !ok {
+		o = &offender{}
+		l.offenders[who] = o
+	}
+	cutoff := now.Add(-l.limits.BanWindow)
+	i := 0
+	for i < len(o.violations) && o.violations[i].Before(cutoff) {
+		i++
+	}
+	o.violations = append(o.violations[i:], now)
+	if len(o.violations) < l.limits.BanAfter {
+		return false
+	}
+	o.violations = nil
+	o.bannedTill = now.Add(l.limits.BanDuration)
+	metrics.Add("bans", 1)
+	l.logger.Printf("banned %s for %s", who, l.limits.BanDuration)
+	return true
+}
+
+// sweep forgets refilled buckets and offenders with nothing recent against
+// them, at most once per limiterSweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limiterSweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	for who, o := range l.offenders {
+		if now.After(o.bannedTill) && (len(o.violations) == 0 || now.Sub(o.violations[len(o.violations)-1]) > l.limits.BanWindow) {
+			delete(l.offenders, who)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rewind makes d pass for l, by moving everything it has recorded back by d.
+func rewind(l *Limiter, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.swept = l.swept.Add(-d)
+	for _, b := range l.buckets {
+		b.last = b.last.Add(-d)
+	}
+	for _, o := range l.offenders {
+		for i := range o.violations {
+			o.violations[i] = o.violations[i].Add(-d)
+		}
+		o.bannedTill = o.bannedTill.Add(-d)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	type step struct {
+		// wait passes before the attempt.
+		wait    time.Duration
+		allowed bool
+		banned  bool
+	}
+	limit := RateLimit{PerMinute: 60, Burst: 2}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "allows a burst",
+			steps: []step{{allowed: true}, {allowed: true}, {allowed: false}},
+		},
+		{
+			name: "refills at the rate",
+			steps: []step{
+				{allowed: true}, {allowed: true}, {allowed: false},
+				{wait: time.Second, allowed: true}, {allowed: false},
+			},
+		},
+		{
+			name: "refills no further than the burst",
+			steps: []step{
+				{allowed: true}, {allowed: true},
+				{wait: time.Hour, allowed: true}, {allowed: true}, {allowed: false},
+			},
+		},
+		{
+			name: "bans after repeated violations",
+			steps: []step{
+				{allowed: true}, {allowed: true},
+				{allowed: false}, {allowed: false}, {allowed: false, banned: true},
+				{wait: 10 * time.Second, allowed: false, banned: true},
+			},
+		},
+		{
+			name: "forgives violations outside the window",
+			steps: []step{
+				{allowed: true}, {allowed: true}, {allowed: false}, {allowed: false},
+				{wait: 2 * time.Minute, allowed: true}, {allowed: true}, {allowed: false},
+			},
+		},
+		{
+			name: "lifts the ban once it is served",
+			steps: []step{
+				{allowed: true}, {allowed: true},
+				{allowed: false}, {allowed: false}, {allowed: false, banned: true},
+				{wait: 11 * time.Minute, allowed: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(&RateLimits{BanAfter: 3, BanWindow: time.Minute, BanDuration: 10 * time.Minute})
+			for i, s := range tt.steps {
+				rewind(l, s.wait)
+				banned, err := l.Allow("user:alice", "messages", limit)
+				if (err == nil) != s.allowed || banned != s.banned {
+					t.Fatalf("attempt %d: allowed %v, banned %v, want %v, %v (%v)", i, err == nil, banned, s.allowed, s.banned, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterKeepsCountsApart(t *testing.T) {
+	l := NewLimiter(&RateLimits{BanAfter: 2, BanWindow: time.Minute, BanDuration: time.Minute})
+	limit := RateLimit{PerMinute: 1, Burst: 1}
+	l.Allow("user:alice", "messages", limit)
+	if _, err := l.Allow("user:alice", "reads", limit); err != nil {
+		t.Errorf("a full messages bucket limited reads: %s", err)
+	}
+	if _, err := l.Allow("user:bob", "messages", limit); err != nil {
+		t.Errorf("alice's bucket limited bob: %s", err)
+	}
+
+	// A ban earned in one bucket refuses every other.
+	l.Allow("user:alice", "messages", limit)
+	if banned, _ := l.Allow("user:alice", "messages", limit); !banned {
+		t.Fatalf("alice wasn't banned")
+	}
+	if banned, err := l.Allow("user:alice", "connections", limit); !banned || err == nil {
+		t.Errorf("a ban didn't refuse alice's connections")
+	}
+	if left := l.BannedFor("user:alice"); left <= 0 || left > time.Minute {
+		t.Errorf("BannedFor = %s, want up to a minute", left)
+	}
+}
+
+func TestLimiterSpareNeverBans(t *testing.T) {
+	l := NewLimiter(&RateLimits{BanAfter: 1, BanWindow: time.Minute, BanDuration: time.Minute})
+	limit := RateLimit{PerMinute: 1, Burst: 1}
+	if err := l.Spare("user:alice", "reads", limit); err != nil {
+		t.Fatalf("first read refused: %s", err)
+	}
+	for range 5 {
+		if err := l.Spare("user:alice", "reads", limit); err == nil {
+			t.Fatalf("read allowed past the limit")
+		}
+	}
+	if left := l.BannedFor("user:alice"); left != 0 {
+		t.Errorf("alice banned for %s after running out of reads", left)
+	}
+}
+
+func TestLimiterChangingLimitDoesNotRefill(t *testing.T) {
+	l := NewLimiter(&RateLimits{BanAfter: 100, BanWindow: time.Minute, BanDuration: time.Minute})
+	guest := RateLimit{PerMinute: 1, Burst: 2}
+	user := RateLimit{PerMinute: 1, Burst: 3}
+	allowed := 0
+	for i := range 10 {
+		limit := guest
+		if i%2 == 1 {
+			limit = user
+		}
+		if _, err := l.Allow("ip:10.0.0.1", "connections", limit); err == nil {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d connections alternating limits, want the first burst of 2", allowed)
+	}
+}
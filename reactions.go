@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// messageUpdate is a change to a stored message (an edit, deletion or reaction)
+// that the manager pushes to everyone who can see the message.
+type messageUpdate struct {
+	typ string
+	msg *templates.Message
+}
+
+// react toggles the client's emoji reaction on a message and pushes the new
+// counts to everyone who can see it.
+func (c *Client) react(idStr, emoji string) error {
+	if c.guest != nil {
+		return fmt.Errorf("Guests can't react to messages. Sign up to join in.")
+	}
+	if !slices.Contains(templates.ReactionEmoji, emoji) {
+		return fmt.Errorf("You can't react with %q.", emoji)
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return fmt.Errorf("%q is not a message id.", idStr)
+	}
+	msg, err := c.manager.store.GetMessage(id)
+	if err != nil || msg.Deleted || !c.canSee(msg) {
+		return fmt.Errorf("That message doesn't exist.")
+	}
+	if _, err := c.manager.store.ToggleReaction(id, c.username, emoji); err != nil {
+		log.Printf("toggle reaction error: %s", err)
+		return fmt.Errorf("Failed to react to the message.")
+	}
+	if msg, err = c.manager.store.GetMessage(id); err != nil {
+		log.Printf("get message error: %s", err)
+		return fmt.Errorf("Failed to react to the message.")
+	}
+	send(c.manager, c.manager.updates, &messageUpdate{typ: protocol.TypeReact, msg: msg})
+	return nil
+}
+
+// canSee reports whether msg is in the client's room or a direct message they are part of.
+func (c *Client) canSee(msg *templates.Message) bool {
+	if msg.Recipient != "" {
+		return msg.Sender == c.username || msg.Recipient == c.username
+	}
+	return msg.Room == c.room
+}
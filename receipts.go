@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// Read markers are kept per user and conversation. A conversation is a room
+// name, or "@" and the other user for direct messages; room names can't start
+// with "@" so the two never collide.
+
+func directConversation(peer string) string {
+	return "@" + peer
+}
+
+// conversationURL is where the conversation is read in the browser.
+func conversationURL(conversation string) string {
+	if peer, ok := strings.CutPrefix(conversation, "@"); ok {
+		return "/dm/" + peer
+	}
+	return "/rooms/" + conversation
+}
+
+// receiptsEnabled reports whether "seen by" receipts are shown. READ_RECEIPTS=false
+// turns them off; unread counts are kept either way.
+func receiptsEnabled() bool {
+	return os.Getenv("READ_RECEIPTS") != "false"
+}
+
+// readEvent is a user's read marker moving forward in a conversation.
+type readEvent struct {
+	// client is the reader's client, unless the event came from another server.
+	client       *Client
+	username     string
+	conversation string
+	from, to     int
+	// unread is the reader's new unread counts and moved the messages whose
+	// receipts changed. load fills them in before the manager sees the event.
+	unread map[string]int
+	moved  []*templates.Message
+}
+
+// load looks up what the manager needs to handle the event, so it doesn't
+// query the store on its own goroutine. Unread counts are only fetched when
+// unread is set, as they are only kept for users online here.
+func (ev *readEvent) load(store Storage, unread bool) {
+	if unread {
+		counts, err := store.GetUnreadCounts(ev.username)
+		if err != nil {
+			log.Printf("error getting unread counts: %s", err)
+		}
+		ev.unread = counts
+	}
+	if !receiptsEnabled() {
+		return
+	}
+	room, peer := ev.conversation, ""
+	if p, ok := strings.CutPrefix(ev.conversation, "@"); ok {
+		room, peer = "", p
+	}
+	markers := readMarkers(store, room, ev.username, peer)
+	ev.moved = []*templates.Message{}
+	for _, id := range []int{ev.from, ev.to} {
+		if msg, err := store.GetMessage(id); err == nil {
+			ev.moved = append(ev.moved, msg)
+		}
+	}
+	applyReceipts(ev.moved, markers)
+}
+
+// conversation is what the client is reading: its direct message peer or its room.
+func (c *Client) conversation() string {
+	if c.peer != "" {
+		return directConversation(c.peer)
+	}
+	return c.room
+}
+
+// markRead records that the client has read up to the message idStr names,
+// or everything in its conversation when idStr is empty.
+func (c *Client) markRead(idStr string) error {
+	// Guest names don't outlive the session, so there is nothing to keep.
+	if c.guest != nil {
+		return nil
+	}
+	id, err := c.lastRead(idStr)
+	if err != nil || id == 0 {
+		return err
+	}
+	conversation := c.conversation()
+	previous, err := c.manager.store.MarkRead(c.username, conversation, id)
+	if err != nil {
+		log.Printf("mark read error: %s", err)
+		return fmt.Errorf("Failed to mark messages read.")
+	}
+	if id > previous {
+		ev := &readEvent{client: c, username: c.username, conversation: conversation, from: previous, to: id}
+		ev.load(c.manager.store, true)
+		send(c.manager, c.manager.reads, ev)
+	}
+	return nil
+}
+
+// lastRead resolves the message a read event points at.
+func (c *Client) lastRead(idStr string) (int, error) {
+	if idStr == "" {
+		q := &MessageQuery{Room: c.room, Limit: 1}
+		if c.peer != "" {
+			q = &MessageQuery{Between: [2]string{c.username, c.peer}, Limit: 1}
+		}
+		latest, err := c.manager.store.GetMessages(q)
+		if err != nil || len(latest) == 0 {
+			return 0, err
+		}
+		return latest[len(latest)-1].Id, nil
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a message id.", idStr)
+	}
+	msg, err := c.manager.store.GetMessage(id)
+	if err != nil || !c.canSee(msg) || msg.ParentId != 0 {
+		return 0, fmt.Errorf("That message doesn't exist.")
+	}
+	if c.peer != "" && msg.Sender != c.peer && msg.Recipient != c.peer {
+		return 0, fmt.Errorf("That message isn't in this conversation.")
+	}
+	return id, nil
+}
+
+// readMarkers returns how far each reader has got in a room, or for direct
+// messages between user and peer, how far each of them has got.
+func readMarkers(store Storage, room, user, peer string) map[string]int {
+	if room != "" {
+		markers, err := store.GetReadMarkers(room)
+		if err != nil {
+			log.Println(err)
+		}
+		return markers
+	}
+	markers := make(map[string]int)
+	for reader, other := range map[string]string{user: peer, peer: user} {
+		theirs, err := store.GetReadMarkers(directConversation(other))
+		if err != nil {
+			log.Println(err)
+		}
+		if id, ok := theirs[reader]; ok {
+			markers[reader] = id
+		}
+	}
+	return markers
+}
+
+// applyReceipts sets SeenBy on each message someone's read marker points at.
+// People aren't listed on their own messages.
+func applyReceipts(messages []*templates.Message, markers map[string]int) {
+	for _, msg := range messages {
+		msg.SeenBy = nil
+		for reader, id := range markers {
+			if id == msg.Id && reader != msg.Sender {
+				msg.SeenBy = append(msg.SeenBy, reader)
+			}
+		}
+		slices.Sort(msg.SeenBy)
+	}
+}
+
+// withReceipts adds "seen by" receipts to a page of a room or direct message conversation.
+func (s *ClientServer) withReceipts(messages []*templates.Message, room, user, peer string) {
+	if receiptsEnabled() {
+		applyReceipts(messages, readMarkers(s.store, room, user, peer))
+	}
+}
+
+// markedRead handles a loaded read event on the manager goroutine: the reader's
+// unread counts drop, and everyone in the conversation sees their receipt move.
+func (manager *ClientManager) markedRead(ev *readEvent) {
+	if ev.unread != nil && manager.online(ev.username) {
+		manager.unread[ev.username] = ev.unread
+		manager.publishUnread(ev.username)
+	}
+	if ev.moved == nil {
+		return
+	}
+	route := &templates.Message{Room: ev.conversation, Sender: ev.username, Datetime: time.Now()}
+	if peer, ok := strings.CutPrefix(ev.conversation, "@"); ok {
+		route.Room, route.Recipient = "", peer
+	}
+	f := newFrame(templates.WsSeenBy(ev.moved), protocol.TypeRead, route)
+	f.envelope.ID = strconv.Itoa(ev.to)
+	manager.route(route, f)
+}
+
+// cacheUnread keeps counts as username's unread counts, unless they are already
+// cached, and sends them to all of the user's clients. counts was loaded before
+// the client registered; the cache has kept up with every message since.
+func (manager *ClientManager) cacheUnread(username string, counts map[string]int) {
+	if _, ok := manager.unread[username]; !ok {
+		if counts == nil {
+			return
+		}
+		manager.unread[username] = counts
+	}
+	manager.publishUnread(username)
+}
+
+// countUnread bumps the unread counts of everyone msg is news to.
+func (manager *ClientManager) countUnread(msg *templates.Message) {
+	if msg.ParentId != 0 {
+		return
+	}
+	for username, counts := range manager.unread {
+		conversation := msg.Room
+		if msg.Recipient != "" {
+			if msg.Recipient != username {
+				continue
+			}
+			conversation = directConversation(msg.Sender)
+		} else if _, ok := counts[conversation]; !ok || msg.Sender == username {
+			// Rooms only count once the user has read them.
+			continue
+		}
+		counts[conversation]++
+		manager.publishUnread(username)
+	}
+}
+
+// publishUnread sends username's unread counts to every one of their clients.
+func (manager *ClientManager) publishUnread(username string) {
+	counts := manager.unread[username]
+	unread := []templates.Unread{}
+	for conversation, n := range counts {
+		if n > 0 {
+			unread = append(unread, templates.Unread{Name: conversation, URL: conversationURL(conversation), Count: n})
+		}
+	}
+	slices.SortFunc(unread, func(a, b templates.Unread) int { return strings.Compare(a.Name, b.Name) })
+	f := newFrame(templates.WsUnread(unread), protocol.TypeUnread, &templates.Message{Recipient: username, Datetime: time.Now()})
+	f.envelope.ID = ""
+	f.envelope.Unread = maps.Clone(counts)
+	f.key = "unread"
+	for client := range manager.clients {
+		if client.username == username {
+			manager.deliver(client, f)
+		}
+	}
+}
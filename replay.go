@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// DefaultReplayLimit is the most messages replayed to a reconnecting client.
+// REPLAY_LIMIT overrides it, up to one less than MaxPageSize.
+const DefaultReplayLimit = 100
+
+func replayLimitFromEnv() int {
+	return min(max(envInt("REPLAY_LIMIT", DefaultReplayLimit), 1), MaxPageSize-1)
+}
+
+// sinceParam reads the id of the last message a reconnecting client saw.
+func sinceParam(s string) int {
+	since, err := strconv.Atoi(s)
+	if err != nil || since < 0 {
+		return 0
+	}
+	return since
+}
+
+// recentMessages is how many of the latest delivered messages the manager
+// remembers for clients that register while their replay is loading.
+const recentMessages = 256
+
+// recentMessage is a delivered message and its place in delivery order.
+type recentMessage struct {
+	seq int64
+	msg *templates.Message
+}
+
+// remember records msg as the latest message delivered here.
+func (manager *ClientManager) remember(msg *templates.Message) {
+	manager.recent = append(manager.recent, recentMessage{seq: manager.delivered.Add(1), msg: msg})
+	if len(manager.recent) > recentMessages {
+		manager.recent = manager.recent[1:]
+	}
+}
+
+// catchUp adds to loaded, which was looked up off the manager goroutine once
+// seq messages had been delivered, those keep accepts that were delivered here
+// since, and sorts it by id. It reports false if the recent messages no longer
+// reach back that far, so some may be missing. It runs on the manager goroutine.
+func (manager *ClientManager) catchUp(loaded []*templates.Message, seq int64, keep func(*templates.Message) bool) ([]*templates.Message, bool) {
+	complete := len(manager.recent) == 0 || manager.recent[0].seq <= seq+1
+	for _, recent := range manager.recent {
+		msg := recent.msg
+		if recent.seq > seq && keep(msg) &&
+			!slices.ContainsFunc(loaded, func(m *templates.Message) bool { return m.Id == msg.Id }) {
+			loaded = append(loaded, msg)
+		}
+	}
+	slices.SortFunc(loaded, func(a, b *templates.Message) int { return a.Id - b.Id })
+	return loaded, complete
+}
+
+// loadReplay looks up the messages a reconnecting client missed while it was
+// away. It runs before the client registers, off the manager goroutine.
+func (manager *ClientManager) loadReplay(client *Client) error {
+	client.seen = manager.delivered.Load()
+	missed, err := manager.missed(client)
+	client.missed = missed
+	return err
+}
+
+// replay sends a reconnecting client the messages it missed while it was away:
+// those loadReplay found, and those delivered here since it ran. It runs on the
+// manager goroutine as the client registers, so the replay comes before
+// anything live. If there is too much to replay, the client is told to reload
+// its history instead.
+func (manager *ClientManager) replay(client *Client) {
+	missed, complete := manager.catchUp(client.missed, client.seen, func(msg *templates.Message) bool {
+		return msg.Id > client.since && client.follows(msg)
+	})
+	if len(missed) > manager.replayLimit || !complete {
+		text := fmt.Sprintf("You missed more than %d messages while disconnected.", manager.replayLimit)
+		msg := &templates.Message{Sender: SystemSender, Recipient: client.username, Room: client.room, Payload: text, Datetime: time.Now()}
+		f := newFrame(templates.WsReload(text), protocol.TypeReload, msg)
+		f.envelope.ID = ""
+		manager.deliver(client, f)
+		return
+	}
+	for _, msg := range missed {
+		typ := protocol.TypeMessage
+		if msg.Recipient != "" {
+			typ = protocol.TypeWhisper
+		}
+		manager.deliver(client, newFrame(templates.WsChatMessage(msg), typ, msg))
+	}
+	if len(missed) > 0 {
+		manager.logger.Printf("replayed %d messages to /Socket [%s]", len(missed), client.conn.RemoteAddr())
+	}
+}
+
+// missed lists the messages in client's room or conversation newer than the
+// one it last saw, oldest first, and at most one more than the replay limit.
+// Messages still waiting to be stored are included.
+func (manager *ClientManager) missed(client *Client) ([]*templates.Message, error) {
+	q := &MessageQuery{Room: client.room, After: client.since, Limit: manager.replayLimit + 1}
+	if client.peer != "" {
+		q.Between = [2]string{client.username, client.peer}
+	}
+	missed, err := manager.persist.withUnstored(func() ([]*templates.Message, error) {
+		return manager.store.GetMessages(q)
+	}, func(msg *templates.Message) bool {
+		return msg.Id > client.since && client.follows(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return missed[:min(len(missed), manager.replayLimit+1)], nil
+}
+
+// follows reports whether msg belongs in the feed client shows: its room's
+// messages, or its direct message conversation.
+func (c *Client) follows(msg *templates.Message) bool {
+	if c.peer != "" {
+		return between(msg, c.username, c.peer)
+	}
+	return msg.Recipient == "" && msg.ParentId == 0 && msg.Room == c.room
+}
+
+// between reports whether msg is a direct message between user and peer.
+func between(msg *templates.Message, user, peer string) bool {
+	return (msg.Sender == user && msg.Recipient == peer) || (msg.Sender == peer && msg.Recipient == user)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// Servers sharing a Broker each own their clients. What happens to a client
+// is handled locally first and then published, and every server applies what
+// the others publish to its own clients. Presence is shared as a snapshot of
+// each server's rooms, so a server that dies without a word is forgotten once
+// its heartbeats stop.
+
+// remoteTimeout is how long another server can go without a presence heartbeat
+// before its users are dropped from online lists.
+const remoteTimeout = 3 * presenceInterval
+
+// outgoingQueueSize is how many events can wait to be published.
+const outgoingQueueSize = 1024
+
+// remoteServer is what the manager knows about another server on its broker.
+type remoteServer struct {
+	seen time.Time
+	// rooms lists the users connected to the server in each room.
+	rooms map[string][]templates.Presence
+}
+
+// publish queues event for the other servers. It never blocks the manager; if
+// the broker has fallen far behind, the event is dropped.
+func (manager *ClientManager) publish(event *Event) {
+	event.Origin = manager.id
+	select {
+	case manager.outgoing <- event:
+	default:
+		metrics.Add("broker_dropped", 1)
+		manager.logger.Printf("broker queue full, dropping %s event", event.Kind)
+	}
+}
+
+// forward publishes queued events until the queue is closed.
+func (manager *ClientManager) forward() {
+	defer close(manager.forwarded)
+	for event := range manager.outgoing {
+		if err := manager.broker.Publish(event); err != nil {
+			manager.logger.Printf("error publishing %s event: %s", event.Kind, err)
+		}
+	}
+}
+
+// apply handles an event published by another server.
+func (manager *ClientManager) apply(event *Event) {
+	if event.Origin == manager.id {
+		return
+	}
+	switch event.Kind {
+	case EventMessage:
+		manager.deliverMessage(event.Message)
+	case EventUpdate:
+		manager.routeUpdate(event.Update, event.Message)
+	case EventReplies:
+		go manager.updateReplyCount(event.ID)
+	case EventPresence:
+		manager.remotePresence(event.Origin, event.Presence)
+	case EventAnnounce:
+		if room, ok := manager.rooms[event.Room]; ok {
+			manager.announce(room, event.Payload)
+		}
+	case EventTyping:
+		if room, ok := manager.rooms[event.Room]; ok {
+			if event.Typing {
+				manager.setTyping(room, event.Username)
+			} else {
+				manager.stopTyping(room, event.Username)
+			}
+		}
+	case EventRead:
+		ev := &readEvent{username: event.Username, conversation: event.Conversation, from: event.From, to: event.ID}
+		online := manager.online(ev.username)
+		go func() {
+			ev.load(manager.store, online)
+			manager.later(func() { manager.markedRead(ev) })
+		}()
+	default:
+		manager.logger.Printf("ignoring unknown %q event", event.Kind)
+	}
+}
+
+// sharePresence tells the other servers who is connected here, room by room.
+func (manager *ClientManager) sharePresence() {
+	now := time.Now()
+	rooms := make(map[string][]templates.Presence)
+	for name, room := range manager.rooms {
+		rooms[name] = manager.localPresence(room, now)
+	}
+	manager.publish(&Event{Kind: EventPresence, Presence: rooms})
+}
+
+// remotePresence records who is connected to another server, and refreshes the
+// online lists of the local rooms where that changed.
+func (manager *ClientManager) remotePresence(origin string, rooms map[string][]templates.Presence) {
+	var before map[string][]templates.Presence
+	if server, ok := manager.remote[origin]; ok {
+		before = server.rooms
+	}
+	if len(rooms) == 0 {
+		delete(manager.remote, origin)
+	} else {
+		manager.remote[origin] = &remoteServer{seen: time.Now(), rooms: rooms}
+	}
+	manager.refreshRooms(before, rooms)
+}
+
+// refreshRooms republishes the online list of every local room whose remote
+// users differ between before and after.
+func (manager *ClientManager) refreshRooms(before, after map[string][]templates.Presence) {
+	for name, room := range manager.rooms {
+		if !slices.Equal(before[name], after[name]) {
+			manager.publishPresence(room)
+		}
+	}
+}
+
+// expireRemotes forgets the servers that stopped sending heartbeats.
+func (manager *ClientManager) expireRemotes(now time.Time) {
+	for origin, server := range manager.remote {
+		if now.Sub(server.seen) > remoteTimeout {
+			manager.logger.Printf("lost contact with server %s", origin)
+			delete(manager.remote, origin)
+			manager.refreshRooms(server.rooms, nil)
+		}
+	}
+}
+
+// remoteUsers lists the users connected to other servers in room, or in any
+// room if room is empty. Someone connected to several servers is listed once for each.
+func (manager *ClientManager) remoteUsers(room string) []templates.Presence {
+	users := []templates.Presence{}
+	for _, server := range manager.remote {
+		for name, present := range server.rooms {
+			if room == "" || name == room {
+				users = append(users, present...)
+			}
+		}
+	}
+	return users
+}
@@ -0,0 +1,38 @@
+package main
+
+import "regexp"
+
+// DefaultRoom is the room clients land in when they don't ask for one.
+const DefaultRoom = "lobby"
+
+// Room is a named group of clients that share a chat feed.
+// Rooms are owned by the ClientManager and must only be touched from its goroutine.
+type Room struct {
+	name    string
+	clients map[*Client]bool
+}
+
+func NewRoom(name string) *Room {
+	return &Room{
+		name:    name,
+		clients: make(map[*Client]bool),
+	}
+}
+
+func (r *Room) Empty() bool {
+	return len(r.clients) == 0
+}
+
+var roomNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// ValidRoomName reports whether name can be used as a room name.
+// Room names end up in URLs, so they are kept to a small safe alphabet.
+func ValidRoomName(name string) bool {
+	return roomNamePattern.MatchString(name)
+}
+
+// roomRequest asks the ClientManager to move a client in or out of a room.
+type roomRequest struct {
+	client *Client
+	room   string
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gin-gonic/gin"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// sessionDuration matches the expiry CreateJWT puts on the token.
+const sessionDuration = 24 * time.Hour
+
+type credentials struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+func (cr *credentials) validate() error {
+	cr.Username = strings.TrimSpace(cr.Username)
+	if err := validUsername(cr.Username, false); err != nil {
+		return err
+	}
+	if len(cr.Password) < 6 {
+		return fmt.Errorf("password must be at least 6 characters")
+	}
+	return nil
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// validUsername checks name against the rules every username follows, whether
+// picked at signup or as a guest nickname. Usernames end up in URLs and command
+// arguments, so they are kept to the same small alphabet as room names. Only
+// guests' names start with GuestPrefix, and nobody can be SystemSender.
+func validUsername(name string, guest bool) error {
+	if name == "" || len(name) > 50 {
+		return fmt.Errorf("username must be between 1 and 50 characters")
+	}
+	if !usernamePattern.MatchString(name) {
+		return fmt.Errorf("usernames may only use letters, numbers, - and _")
+	}
+	if strings.HasPrefix(name, GuestPrefix) != guest {
+		return fmt.Errorf("usernames starting with %q are reserved", GuestPrefix)
+	}
+	if strings.EqualFold(name, SystemSender) {
+		return fmt.Errorf("the username %q is reserved", SystemSender)
+	}
+	return nil
+}
+
+// wantsJSON reports whether the request came from an API client rather than an html form.
+func wantsJSON(c *gin.Context) bool {
+	return strings.HasPrefix(c.ContentType(), "application/json")
+}
+
+func (s *ClientServer) HandleSignupPage(c *gin.Context) {
+	templates.SignupPage("").Render(c.Request.Context(), c.Writer)
+}
+
+func (s *ClientServer) HandleLoginPage(c *gin.Context) {
+	templates.LoginPage("").Render(c.Request.Context(), c.Writer)
+}
+
+func (s *ClientServer) HandleSignup(c *gin.Context) {
+	if status, err := s.throttle(c, ipKey(c.ClientIP()), "logins", s.limiter.limits.Logins); err != nil {
+		s.authError(c, status, err.Error(), templates.SignupPage)
+		return
+	}
+	cr := new(credentials)
+	if err := c.ShouldBind(cr); err != nil {
+		s.authError(c, http.StatusBadRequest, "invalid signup request", templates.SignupPage)
+		return
+	}
+	if err := cr.validate(); err != nil {
+		s.authError(c, http.StatusBadRequest, err.Error(), templates.SignupPage)
+		return
+	}
+	if _, err := s.store.GetUser(cr.Username); err == nil {
+		s.authError(c, http.StatusConflict, "username already taken", templates.SignupPage)
+		return
+	}
+	hash, err := HashPassword(cr.Password)
+	if err != nil {
+		s.logger.Printf("hash password error: %s", err)
+		s.authError(c, http.StatusInternalServerError, "failed to create user", templates.SignupPage)
+		return
+	}
+	usr := &User{Username: cr.Username, Password: hash, Role: RoleUser}
+	if err := s.store.CreateUser(usr); err != nil {
+		s.logger.Printf("create user error: %s", err)
+		s.authError(c, http.StatusInternalServerError, "failed to create user", templates.SignupPage)
+		return
+	}
+	s.logger.Printf("New User: %s", usr.Username)
+	s.startSession(c, http.StatusCreated, usr, templates.SignupPage)
+}
+
+func (s *ClientServer) HandleLogin(c *gin.Context) {
+	if status, err := s.throttle(c, ipKey(c.ClientIP()), "logins", s.limiter.limits.Logins); err != nil {
+		s.authError(c, status, err.Error(), templates.LoginPage)
+		return
+	}
+	cr := new(credentials)
+	if err := c.ShouldBind(cr); err != nil {
+		s.authError(c, http.StatusBadRequest, "invalid login request", templates.LoginPage)
+		return
+	}
+	usr, err := s.store.GetUser(strings.TrimSpace(cr.Username))
+	if err != nil || !VerifyPassword(cr.Password, usr.Password) {
+		s.authError(c, http.StatusUnauthorized, "invalid username or password", templates.LoginPage)
+		return
+	}
+	s.startSession(c, http.StatusOK, usr, templates.LoginPage)
+}
+
+func (s *ClientServer) HandleLogout(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if wantsJSON(c) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// startSession issues a JWT for usr, sets it as the session cookie and responds
+// with either the token (JSON) or a redirect to the chat (html form).
+func (s *ClientServer) startSession(c *gin.Context, status int, usr *User, page func(string) templ.Component) {
+	token, err := CreateJWT(usr)
+	if err != nil {
+		s.logger.Printf("create jwt error: %s", err)
+		s.authError(c, http.StatusInternalServerError, "failed to create session", page)
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if wantsJSON(c) {
+		c.JSON(status, gin.H{"token": token, "username": usr.Username})
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// authError reports a failed auth request as JSON or by re-rendering the form with the message.
+func (s *ClientServer) authError(c *gin.Context, status int, msg string, page func(string) templ.Component) {
+	if wantsJSON(c) {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	c.Status(status)
+	page(msg).Render(c.Request.Context(), c.Writer)
+}
+
+// sessionUser returns the username of the request's session, if it has a valid one.
+func sessionUser(c *gin.Context) (string, bool) {
+	tokenString, _ := TokenFromRequest(c.Request)
+	claims, err := ClaimsFromToken(tokenString)
+	if err != nil {
+		return "", false
+	}
+	return claims.Username, true
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// SQLiteStore is a Storage backed by a single SQLite file, for deployments that
+// don't want to run Postgres. Its schema mirrors PostgresStore's, see migrations/sqlite.
+type SQLiteStore struct {
+	db *sql.DB
+	// lastID is the last message id handed out. SQLite has no sequences, so
+	// ids are counted here; only one process uses the file.
+	mu     sync.Mutex
+	lastID int
+}
+
+// NewSQLiteStore opens the database file named by DB_CONN_STR, defaulting to mchat.db.
+func NewSQLiteStore() (*SQLiteStore, error) {
+	path := os.Getenv("DB_CONN_STR")
+	if path == "" {
+		path = "mchat.db"
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids "database is locked" errors
+	// and keeps the pragmas below in effect for every query.
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", "PRAGMA foreign_keys=ON"} {
+		if _, err := db.Exec(pragma); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLiteStore{
+		db: db,
+	}, nil
+}
+
+// Init brings the schema up to date, refusing to start against a database
+// migrated by a newer binary.
+func (s *SQLiteStore) Init() error {
+	m, err := s.Migrator()
+	if err != nil {
+		return err
+	}
+	return m.Up()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Migrator() (*Migrator, error) {
+	return NewMigrator(s.db, "sqlite")
+}
+
+func (s *SQLiteStore) CreateUser(usr *User) error {
+	query := `INSERT INTO users (username, pass) VALUES ($1, $2) RETURNING id`
+	row := s.db.QueryRow(query, usr.Username, usr.Password)
+	if err := row.Scan(&usr.Id); err != nil {
+		return fmt.Errorf("failed to create user")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetUser(username string) (*User, error) {
+	query := `SELECT id, username, pass, role FROM users WHERE username=$1`
+	row := s.db.QueryRow(query, username)
+	usr := new(User)
+	if err := row.Scan(&usr.Id, &usr.Username, &usr.Password, &usr.Role); err != nil {
+		return nil, fmt.Errorf("failed to get user")
+	}
+	return usr, nil
+}
+
+func (s *SQLiteStore) SetUserRole(username, role string) error {
+	return setUserRole(s.db, username, role)
+}
+
+func (s *SQLiteStore) GetUsers() ([]*User, error) {
+	rows, err := s.db.Query(`SELECT id, username FROM users`)
+	if err != nil {
+		log.Printf("get users error: %s\n", err.Error())
+		return nil, fmt.Errorf("failed to get users")
+	}
+	defer rows.Close()
+	usrs := []*User{}
+	for rows.Next() {
+		usr := new(User)
+		if err := rows.Scan(&usr.Id, &usr.Username); err != nil {
+			log.Printf("get users error: %s\n", err)
+			continue
+		}
+		usrs = append(usrs, usr)
+	}
+	return usrs, nil
+}
+
+// StoreMessage takes its id from ReserveMessageIDs too, so it can't collide
+// with ids handed out for messages still waiting to be stored.
+func (s *SQLiteStore) StoreMessage(msg *templates.Message) error {
+	ids, err := s.ReserveMessageIDs(1)
+	if err != nil {
+		return fmt.Errorf("failed to create new message: %s", err)
+	}
+	stored := *msg
+	stored.Id = ids[0]
+	if err := s.StoreMessages([]*templates.Message{&stored}); err != nil {
+		return fmt.Errorf("failed to create new message: %s", err)
+	}
+	msg.Id = stored.Id
+	return nil
+}
+
+func (s *SQLiteStore) ReserveMessageIDs(n int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastID == 0 {
+		row := s.db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'messages'`)
+		if err := row.Scan(&s.lastID); err != nil {
+			return nil, fmt.Errorf("failed to reserve message ids: %w", err)
+		}
+	}
+	ids := make([]int, n)
+	for i := range ids {
+		s.lastID++
+		ids[i] = s.lastID
+	}
+	return ids, nil
+}
+
+// StoreMessages stores msgs with their timestamps in UTC, like StoreMessage.
+func (s *SQLiteStore) StoreMessages(msgs []*templates.Message) error {
+	utc := make([]*templates.Message, len(msgs))
+	for i, msg := range msgs {
+		m := *msg
+		m.Datetime = msg.Datetime.UTC()
+		utc[i] = &m
+	}
+	return storeMessages(s.db, utc)
+}
+
+func (s *SQLiteStore) GetMessage(id int) (*templates.Message, error) {
+	return getMessage(s.db, id)
+}
+
+func (s *SQLiteStore) UpdateMessage(id int, payload string) error {
+	return updateMessage(s.db, id, payload, time.Now().UTC())
+}
+
+func (s *SQLiteStore) DeleteMessage(id int) error {
+	return deleteMessage(s.db, id)
+}
+
+func (s *SQLiteStore) ToggleReaction(messageID int, username, emoji string) (bool, error) {
+	return toggleReaction(s.db, messageID, username, emoji)
+}
+
+// GetMessages returns one page of room messages matching q, oldest first.
+func (s *SQLiteStore) GetMessages(q *MessageQuery) ([]*templates.Message, error) {
+	utc := *q
+	utc.Since, utc.Until = q.Since.UTC(), q.Until.UTC()
+	return queryMessages(s.db, &utc)
+}
+
+// GetThread returns the replies to the message parentID, oldest first.
+func (s *SQLiteStore) GetThread(parentID int) ([]*templates.Message, error) {
+	return getThread(s.db, parentID)
+}
+
+// MarkRead is markRead for SQLite, whose RETURNING subqueries already see the
+// update, so the previous marker is read first in the same transaction.
+func (s *SQLiteStore) MarkRead(username, conversation string, messageID int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark read: %s", err)
+	}
+	defer tx.Rollback()
+	var previous int
+	err = tx.QueryRow(`SELECT message_id FROM read_markers WHERE username=$1 AND conversation=$2`, username, conversation).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to mark read: %s", err)
+	}
+	_, err = tx.Exec(`INSERT INTO read_markers AS r (username, conversation, message_id) VALUES ($1, $2, $3)
+    ON CONFLICT (username, conversation) DO UPDATE SET message_id = MAX(r.message_id, excluded.message_id)`,
+		username, conversation, messageID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark read: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to mark read: %s", err)
+	}
+	return previous, nil
+}
+
+func (s *SQLiteStore) GetReadMarkers(conversation string) (map[string]int, error) {
+	return getReadMarkers(s.db, conversation)
+}
+
+func (s *SQLiteStore) GetUnreadCounts(username string) (map[string]int, error) {
+	return getUnreadCounts(s.db, username)
+}
+
+// GetConversation returns the direct messages exchanged between users a and b, oldest first.
+func (s *SQLiteStore) GetConversation(a, b string) ([]*templates.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages
+    WHERE (sender=$1 AND recipient=$2) OR (sender=$2 AND recipient=$1)
+    ORDER BY id`
+	rows, err := s.db.Query(query, a, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation")
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, loadDetails(s.db, messages)
+}
+
+// GetInbox returns the latest direct message of every conversation username is part of, newest first.
+func (s *SQLiteStore) GetInbox(username string) ([]*templates.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM (
+      SELECT *, ROW_NUMBER() OVER (
+        PARTITION BY CASE WHEN sender=$1 THEN recipient ELSE sender END ORDER BY id DESC
+      ) AS n
+      FROM messages WHERE COALESCE(recipient, '') <> '' AND (sender=$1 OR recipient=$1)
+    ) WHERE n = 1 ORDER BY datetime DESC`
+	rows, err := s.db.Query(query, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbox")
+	}
+	return scanMessages(rows)
+}
+
+func (s *SQLiteStore) Drop() {
+	for _, table := range []string{"read_markers", "reactions", "messages", "users", "schema_version"} {
+		if _, err := s.db.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			log.Printf("db drop error: %s\n", err)
+		}
+	}
+	log.Println("dropped read marker, reaction, message, user and schema_version tables")
+}
@@ -5,16 +5,108 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/muhreeowki/mchat/templates"
 )
 
 type Storage interface {
+	Init() error
 	StoreMessage(*templates.Message) error
-	GetMessages() ([]*templates.Message, error)
+	// ReserveMessageIDs hands out n unused message ids for StoreMessages.
+	ReserveMessageIDs(n int) ([]int, error)
+	// StoreMessages stores messages that already have ids, skipping any stored before.
+	StoreMessages([]*templates.Message) error
+	GetMessage(id int) (*templates.Message, error)
+	UpdateMessage(id int, payload string) error
+	DeleteMessage(id int) error
+	ToggleReaction(messageID int, username, emoji string) (added bool, err error)
+	GetMessages(*MessageQuery) ([]*templates.Message, error)
+	GetThread(parentID int) ([]*templates.Message, error)
+	GetConversation(a, b string) ([]*templates.Message, error)
+	GetInbox(username string) ([]*templates.Message, error)
+	MarkRead(username, conversation string, messageID int) (previous int, err error)
+	GetReadMarkers(conversation string) (map[string]int, error)
+	GetUnreadCounts(username string) (map[string]int, error)
 	CreateUser(*User) error
 	GetUser(string) (*User, error)
 	GetUsers() ([]*User, error)
+	SetUserRole(username, role string) error
+	// Close releases the database.
+	Close() error
+}
+
+// NewStore opens the Storage selected by the DB_DRIVER environment variable:
+// "postgres" (the default), "sqlite" or "memory". DB_CONN_STR is the DSN for
+// postgres and the database file for sqlite.
+func NewStore() (Storage, error) {
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "postgres":
+		return NewPostgresStore()
+	case "sqlite", "sqlite3":
+		return NewSQLiteStore()
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+}
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// MessageQuery filters and pages through room message history, or with Between
+// set, the direct messages between two users. Zero values mean "no filter".
+// Pages are keyed on message id: Before returns the newest messages older than
+// that id, After the oldest messages newer than it.
+type MessageQuery struct {
+	Room    string
+	Between [2]string
+	Sender  string
+	Since   time.Time
+	Until   time.Time
+	Before  int
+	After   int
+	Limit   int
+}
+
+// direct reports whether the query is for direct messages rather than room messages.
+func (q *MessageQuery) direct() bool {
+	return q.Between != [2]string{}
+}
+
+// matches reports whether msg is one of the messages the query asks for.
+func (q *MessageQuery) matches(msg *templates.Message) bool {
+	if q.direct() {
+		if !between(msg, q.Between[0], q.Between[1]) {
+			return false
+		}
+	} else if msg.Recipient != "" || msg.ParentId != 0 || (q.Room != "" && msg.Room != q.Room) {
+		return false
+	}
+	return (q.Sender == "" || msg.Sender == q.Sender) &&
+		(q.Since.IsZero() || !msg.Datetime.Before(q.Since)) &&
+		(q.Until.IsZero() || msg.Datetime.Before(q.Until)) &&
+		(q.Before == 0 || msg.Id < q.Before) &&
+		(q.After == 0 || msg.Id > q.After)
+}
+
+// forward reports whether the query pages forward from After, taking the oldest
+// matches, rather than back from the newest.
+func (q *MessageQuery) forward() bool {
+	return q.After > 0 && q.Before == 0
+}
+
+// PageSize returns the query's limit clamped to [1, MaxPageSize].
+func (q *MessageQuery) PageSize() int {
+	if q.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return min(q.Limit, MaxPageSize)
 }
 
 type PostgresStore struct {
@@ -37,38 +129,18 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}, nil
 }
 
+// Init brings the schema up to date, refusing to start against a database
+// migrated by a newer binary.
 func (s *PostgresStore) Init() error {
-	if err := s.initUsersTable(); err != nil {
-		log.Println("initialized users table")
-		return fmt.Errorf("users table init error: %s", err)
-	}
-	if err := s.initMessagesTable(); err != nil {
-		log.Println("initialized messages table")
-		return fmt.Errorf("message table init error: %s", err)
+	m, err := s.Migrator()
+	if err != nil {
+		return err
 	}
-	return nil
-}
-
-func (s *PostgresStore) initUsersTable() error {
-	createUserTableQuery := `CREATE TABLE IF NOT EXISTS users (
-    id SERIAL NOT NULL PRIMARY KEY,
-    username VARCHAR(50) UNIQUE NOT NULL,
-    pass TEXT NOT NULL
-  )`
-	_, err := s.db.Exec(createUserTableQuery)
-	return err
+	return m.Up()
 }
 
-func (s *PostgresStore) initMessagesTable() error {
-	createMessageTableQuery := `CREATE TABLE IF NOT EXISTS messages (
-    id SERIAL PRIMARY KEY,
-    payload TEXT NOT NULL,
-    sender TEXT NOT NULL,
-    recipient TEXT,
-    datetime TIMESTAMP DEFAULT NOW()
-  )`
-	_, err := s.db.Exec(createMessageTableQuery)
-	return err
+func (s *PostgresStore) Migrator() (*Migrator, error) {
+	return NewMigrator(s.db, "postgres")
 }
 
 func (s *PostgresStore) CreateUser(usr *User) error {
@@ -81,15 +153,31 @@ func (s *PostgresStore) CreateUser(usr *User) error {
 }
 
 func (s *PostgresStore) GetUser(username string) (*User, error) {
-	query := `SELECT id, username, pass FROM users WHERE username=$1`
+	query := `SELECT id, username, pass, role FROM users WHERE username=$1`
 	row := s.db.QueryRow(query, username)
 	usr := new(User)
-	if err := row.Scan(&usr.Id, &usr.Username, &usr.Password); err != nil {
+	if err := row.Scan(&usr.Id, &usr.Username, &usr.Password, &usr.Role); err != nil {
 		return nil, fmt.Errorf("failed to get user")
 	}
 	return usr, nil
 }
 
+func (s *PostgresStore) SetUserRole(username, role string) error {
+	return setUserRole(s.db, username, role)
+}
+
+// setUserRole is shared by the SQL stores.
+func setUserRole(db *sql.DB, username, role string) error {
+	res, err := db.Exec(`UPDATE users SET role=$1 WHERE username=$2`, role, username)
+	if err != nil {
+		return fmt.Errorf("failed to set user role: %s", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("failed to set user role: no user %q", username)
+	}
+	return nil
+}
+
 func (s *PostgresStore) GetUsers() ([]*User, error) {
 	query := `SELECT id, username FROM users`
 	rows, err := s.db.Query(query)
@@ -110,26 +198,85 @@ func (s *PostgresStore) GetUsers() ([]*User, error) {
 }
 
 func (s *PostgresStore) StoreMessage(msg *templates.Message) error {
-	query := `INSERT INTO messages (payload, sender, recipient, datetime) VALUES ($1, $2, $3, $4) RETURNING payload, sender, recipient, datetime`
-	row := s.db.QueryRow(query, msg.Payload, msg.Sender, msg.Recipient, msg.Datetime)
-	respMsg := new(templates.Message)
-	if err := row.Scan(&respMsg.Payload, &respMsg.Sender, &respMsg.Recipient, &respMsg.Datetime); err != nil {
+	query := `INSERT INTO messages (payload, sender, recipient, room, datetime, parent_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	row := s.db.QueryRow(query, msg.Payload, msg.Sender, msg.Recipient, msg.Room, msg.Datetime, parentID(msg))
+	if err := row.Scan(&msg.Id); err != nil {
 		return fmt.Errorf("failed to create new message: %s", err.Error())
 	}
 	return nil
 }
 
-func (s *PostgresStore) GetMessages() ([]*templates.Message, error) {
-	query := `SELECT payload, sender, datetime FROM messages`
-	rows, err := s.db.Query(query)
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresStore) ReserveMessageIDs(n int) ([]int, error) {
+	rows, err := s.db.Query(`SELECT nextval(pg_get_serial_sequence('messages', 'id')) FROM generate_series(1, $1)`, n)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get messages")
+		return nil, fmt.Errorf("failed to reserve message ids: %w", err)
+	}
+	defer rows.Close()
+	ids := make([]int, 0, n)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to reserve message ids: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *PostgresStore) StoreMessages(msgs []*templates.Message) error {
+	return storeMessages(s.db, msgs)
+}
+
+func (s *PostgresStore) GetMessage(id int) (*templates.Message, error) {
+	return getMessage(s.db, id)
+}
+
+func (s *PostgresStore) UpdateMessage(id int, payload string) error {
+	return updateMessage(s.db, id, payload, time.Now())
+}
+
+func (s *PostgresStore) DeleteMessage(id int) error {
+	return deleteMessage(s.db, id)
+}
+
+func (s *PostgresStore) ToggleReaction(messageID int, username, emoji string) (bool, error) {
+	return toggleReaction(s.db, messageID, username, emoji)
+}
+
+// parentID is the value stored in messages.parent_id: NULL unless msg is a reply.
+func parentID(msg *templates.Message) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(msg.ParentId), Valid: msg.ParentId != 0}
+}
+
+// messageColumns is the column list scanMessage expects.
+const messageColumns = `id, payload, sender, COALESCE(recipient, ''), room, datetime, edited_at, deleted, COALESCE(parent_id, 0)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (*templates.Message, error) {
+	msg := new(templates.Message)
+	var editedAt sql.NullTime
+	if err := row.Scan(&msg.Id, &msg.Payload, &msg.Sender, &msg.Recipient, &msg.Room, &msg.Datetime, &editedAt, &msg.Deleted, &msg.ParentId); err != nil {
+		return nil, err
 	}
+	msg.Edited = editedAt.Valid
+	return msg, nil
+}
+
+// scanMessages reads every row of a query that selected messageColumns.
+func scanMessages(rows *sql.Rows) ([]*templates.Message, error) {
+	defer rows.Close()
 	messages := []*templates.Message{}
 	for rows.Next() {
-		msg := new(templates.Message)
-		if err := rows.Scan(&msg.Payload, &msg.Sender, &msg.Datetime); err != nil {
-			fmt.Printf("get messages error: %s\n", err)
+		msg, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("get messages error: %s\n", err)
 			continue
 		}
 		messages = append(messages, msg)
@@ -137,11 +284,358 @@ func (s *PostgresStore) GetMessages() ([]*templates.Message, error) {
 	return messages, nil
 }
 
+// storeMessages inserts msgs, which already have ids, in a single statement.
+// Rows that already exist are skipped, so a batch whose outcome is unknown
+// can be retried. Errors wrap the driver's, so callers can tell transient ones apart.
+func storeMessages(db *sql.DB, msgs []*templates.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	var query strings.Builder
+	query.WriteString(`INSERT INTO messages (id, payload, sender, recipient, room, datetime, parent_id) VALUES `)
+	args := make([]any, 0, 7*len(msgs))
+	for i, msg := range msgs {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7)
+		args = append(args, msg.Id, msg.Payload, msg.Sender, msg.Recipient, msg.Room, msg.Datetime, parentID(msg))
+	}
+	query.WriteString(` ON CONFLICT (id) DO NOTHING`)
+	if _, err := db.Exec(query.String(), args...); err != nil {
+		return fmt.Errorf("failed to store messages: %w", err)
+	}
+	return nil
+}
+
+func getMessage(db *sql.DB, id int) (*templates.Message, error) {
+	msg, err := scanMessage(db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id=$1`, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message")
+	}
+	if err := loadDetails(db, []*templates.Message{msg}); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func updateMessage(db *sql.DB, id int, payload string, editedAt time.Time) error {
+	res, err := db.Exec(`UPDATE messages SET payload=$1, edited_at=$2 WHERE id=$3 AND NOT deleted`, payload, editedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update message: %s", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("failed to update message: no message %d", id)
+	}
+	return nil
+}
+
+// deleteMessage blanks the message, drops its reactions and marks it deleted,
+// keeping its id so feeds can show where it was.
+func deleteMessage(db *sql.DB, id int) error {
+	res, err := db.Exec(`UPDATE messages SET payload='', deleted=TRUE WHERE id=$1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %s", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("failed to delete message: no message %d", id)
+	}
+	if _, err := db.Exec(`DELETE FROM reactions WHERE message_id=$1`, id); err != nil {
+		return fmt.Errorf("failed to delete message reactions: %s", err)
+	}
+	return nil
+}
+
+// GetMessages returns one page of room messages matching q, oldest first.
+func (s *PostgresStore) GetMessages(q *MessageQuery) ([]*templates.Message, error) {
+	return queryMessages(s.db, q)
+}
+
+// queryMessages runs a MessageQuery against any database with the messages table.
+// It only uses SQL that Postgres and SQLite agree on.
+func queryMessages(db *sql.DB, q *MessageQuery) ([]*templates.Message, error) {
+	// Replies live in their thread, not the room feed.
+	where := []string{"COALESCE(recipient, '') = ''", "parent_id IS NULL"}
+	args := []any{}
+	if q.direct() {
+		where = []string{"((sender=$1 AND recipient=$2) OR (sender=$2 AND recipient=$1))"}
+		args = append(args, q.Between[0], q.Between[1])
+	}
+	filter := func(clause string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if q.Room != "" && !q.direct() {
+		filter("room=$%d", q.Room)
+	}
+	if q.Sender != "" {
+		filter("sender=$%d", q.Sender)
+	}
+	if !q.Since.IsZero() {
+		filter("datetime>=$%d", q.Since)
+	}
+	if !q.Until.IsZero() {
+		filter("datetime<$%d", q.Until)
+	}
+	if q.Before > 0 {
+		filter("id<$%d", q.Before)
+	}
+	if q.After > 0 {
+		filter("id>$%d", q.After)
+	}
+	// Walk forwards from an After cursor, otherwise backwards from the newest message.
+	order := "DESC"
+	if q.After > 0 && q.Before == 0 {
+		order = "ASC"
+	}
+	query := fmt.Sprintf(`SELECT %s FROM messages WHERE %s ORDER BY id %s LIMIT %d`,
+		messageColumns, strings.Join(where, " AND "), order, q.PageSize())
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages")
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if order == "DESC" {
+		slices.Reverse(messages)
+	}
+	return messages, loadDetails(db, messages)
+}
+
+// getThread returns the replies to a message, oldest first.
+func getThread(db *sql.DB, parentID int) ([]*templates.Message, error) {
+	rows, err := db.Query(`SELECT `+messageColumns+` FROM messages WHERE parent_id=$1 ORDER BY id`, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread")
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, loadDetails(db, messages)
+}
+
+// loadDetails fills in the reactions and reply counts of messages.
+func loadDetails(db *sql.DB, messages []*templates.Message) error {
+	if err := loadReactions(db, messages); err != nil {
+		return err
+	}
+	return loadReplyCounts(db, messages)
+}
+
+// idList returns a "$1, $2, ..." placeholder list for the ids of messages, and the ids.
+func idList(messages []*templates.Message) (string, []any) {
+	placeholders := make([]string, len(messages))
+	args := make([]any, len(messages))
+	for i, msg := range messages {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = msg.Id
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// loadReplyCounts counts the replies to each message with one query.
+func loadReplyCounts(db *sql.DB, messages []*templates.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byId := make(map[int]*templates.Message, len(messages))
+	for _, msg := range messages {
+		byId[msg.Id] = msg
+	}
+	placeholders, args := idList(messages)
+	query := `SELECT parent_id, COUNT(*) FROM messages WHERE parent_id IN (` + placeholders + `) GROUP BY parent_id`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to count replies: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return fmt.Errorf("failed to count replies: %s", err)
+		}
+		byId[id].Replies = n
+	}
+	return rows.Err()
+}
+
+// markRead moves username's read marker in conversation forward to messageID.
+// Markers never move backwards. It returns where the marker was before. The
+// upsert is a single statement so concurrent reads can't race each other; its
+// RETURNING subquery sees the table as it was before the statement.
+func markRead(db *sql.DB, username, conversation string, messageID int) (int, error) {
+	var previous sql.NullInt64
+	err := db.QueryRow(`INSERT INTO read_markers AS r (username, conversation, message_id) VALUES ($1, $2, $3)
+    ON CONFLICT (username, conversation) DO UPDATE SET message_id = GREATEST(r.message_id, EXCLUDED.message_id)
+    RETURNING (SELECT message_id FROM read_markers WHERE username=$1 AND conversation=$2)`,
+		username, conversation, messageID).Scan(&previous)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark read: %s", err)
+	}
+	return int(previous.Int64), nil
+}
+
+// getReadMarkers returns how far each user has read conversation.
+func getReadMarkers(db *sql.DB, conversation string) (map[string]int, error) {
+	rows, err := db.Query(`SELECT username, message_id FROM read_markers WHERE conversation=$1`, conversation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get read markers: %s", err)
+	}
+	defer rows.Close()
+	markers := make(map[string]int)
+	for rows.Next() {
+		var username string
+		var id int
+		if err := rows.Scan(&username, &id); err != nil {
+			return nil, fmt.Errorf("failed to get read markers: %s", err)
+		}
+		markers[username] = id
+	}
+	return markers, rows.Err()
+}
+
+// getUnreadCounts counts the messages username hasn't read in every room they
+// have read before, and in every direct message conversation.
+func getUnreadCounts(db *sql.DB, username string) (map[string]int, error) {
+	query := `SELECT r.conversation, COUNT(m.id) FROM read_markers r
+      LEFT JOIN messages m ON m.room = r.conversation AND m.id > r.message_id
+        AND COALESCE(m.recipient, '') = '' AND m.parent_id IS NULL AND m.sender <> r.username
+      WHERE r.username = $1 AND r.conversation NOT LIKE '@%'
+      GROUP BY r.conversation
+    UNION ALL
+    SELECT '@' || m.sender, COUNT(*) FROM messages m
+      LEFT JOIN read_markers r ON r.username = $1 AND r.conversation = '@' || m.sender
+      WHERE m.recipient = $1 AND m.id > COALESCE(r.message_id, 0)
+      GROUP BY m.sender`
+	rows, err := db.Query(query, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unread counts: %s", err)
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var conversation string
+		var n int
+		if err := rows.Scan(&conversation, &n); err != nil {
+			return nil, fmt.Errorf("failed to get unread counts: %s", err)
+		}
+		counts[conversation] = n
+	}
+	return counts, rows.Err()
+}
+
+// toggleReaction adds username's emoji reaction to a message, or removes it if
+// it was already there. It reports whether the reaction was added.
+func toggleReaction(db *sql.DB, messageID int, username, emoji string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM reactions WHERE message_id=$1 AND username=$2 AND emoji=$3`, messageID, username, emoji)
+	if err != nil {
+		return false, fmt.Errorf("failed to toggle reaction: %s", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return false, nil
+	}
+	_, err = db.Exec(`INSERT INTO reactions (message_id, username, emoji) VALUES ($1, $2, $3)`, messageID, username, emoji)
+	if err != nil {
+		return false, fmt.Errorf("failed to toggle reaction: %s", err)
+	}
+	return true, nil
+}
+
+// loadReactions fills in the Reactions of messages with one query.
+func loadReactions(db *sql.DB, messages []*templates.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byId := make(map[int]*templates.Message, len(messages))
+	for _, msg := range messages {
+		byId[msg.Id] = msg
+	}
+	placeholders, args := idList(messages)
+	query := `SELECT message_id, username, emoji FROM reactions WHERE message_id IN (` + placeholders + `) ORDER BY id`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to get reactions: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var username, emoji string
+		if err := rows.Scan(&id, &username, &emoji); err != nil {
+			return fmt.Errorf("failed to get reactions: %s", err)
+		}
+		addReaction(byId[id], username, emoji)
+	}
+	return rows.Err()
+}
+
+// addReaction counts username's emoji on msg, keeping emoji in the order they were first used.
+func addReaction(msg *templates.Message, username, emoji string) {
+	for i := range msg.Reactions {
+		if msg.Reactions[i].Emoji == emoji {
+			msg.Reactions[i].Users = append(msg.Reactions[i].Users, username)
+			return
+		}
+	}
+	msg.Reactions = append(msg.Reactions, templates.Reaction{Emoji: emoji, Users: []string{username}})
+}
+
+// GetThread returns the replies to the message parentID, oldest first.
+func (s *PostgresStore) GetThread(parentID int) ([]*templates.Message, error) {
+	return getThread(s.db, parentID)
+}
+
+func (s *PostgresStore) MarkRead(username, conversation string, messageID int) (int, error) {
+	return markRead(s.db, username, conversation, messageID)
+}
+
+func (s *PostgresStore) GetReadMarkers(conversation string) (map[string]int, error) {
+	return getReadMarkers(s.db, conversation)
+}
+
+func (s *PostgresStore) GetUnreadCounts(username string) (map[string]int, error) {
+	return getUnreadCounts(s.db, username)
+}
+
+// GetConversation returns the direct messages exchanged between users a and b, oldest first.
+func (s *PostgresStore) GetConversation(a, b string) ([]*templates.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages
+    WHERE (sender=$1 AND recipient=$2) OR (sender=$2 AND recipient=$1)
+    ORDER BY id`
+	rows, err := s.db.Query(query, a, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation")
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, loadDetails(s.db, messages)
+}
+
+// GetInbox returns the latest direct message of every conversation username is part of, newest first.
+func (s *PostgresStore) GetInbox(username string) ([]*templates.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM (
+      SELECT DISTINCT ON (partner) * FROM (
+        SELECT *, CASE WHEN sender=$1 THEN recipient ELSE sender END AS partner
+        FROM messages WHERE COALESCE(recipient, '') <> '' AND (sender=$1 OR recipient=$1)
+      ) dms ORDER BY partner, id DESC
+    ) latest ORDER BY datetime DESC`
+	rows, err := s.db.Query(query, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbox")
+	}
+	return scanMessages(rows)
+}
+
 func (s *PostgresStore) Drop() {
-	query := `DROP TABLE IF EXISTS messages, users`
+	query := `DROP TABLE IF EXISTS read_markers, reactions, messages, users, schema_version`
 	_, err := s.db.Exec(query)
 	if err != nil {
 		log.Printf("db drop error: %s\n", err)
 	}
-	log.Println("dropped message and user tables")
+	log.Println("dropped read marker, reaction, message, user and schema_version tables")
 }
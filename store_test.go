@@ -0,0 +1,397 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/mchat/templates"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return NewMemoryStore()
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		t.Setenv("DB_CONN_STR", t.TempDir()+"/mchat.db")
+		store, err := NewSQLiteStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.db.Close() })
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// TestPostgresStore runs the conformance suite against a real database. It drops
+// every table first, so it only runs when TEST_DB_CONN_STR points at a scratch database.
+func TestPostgresStore(t *testing.T) {
+	connStr := os.Getenv("TEST_DB_CONN_STR")
+	if connStr == "" {
+		t.Skip("TEST_DB_CONN_STR not set")
+	}
+	testStorage(t, func(t *testing.T) Storage {
+		t.Setenv("DB_CONN_STR", connStr)
+		store, err := NewPostgresStore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Drop()
+		if err := store.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// testStorage is the conformance suite every Storage implementation must pass.
+// newStore must return an empty, initialized store.
+func testStorage(t *testing.T, newStore func(t *testing.T) Storage) {
+	t.Run("Users", func(t *testing.T) {
+		store := newStore(t)
+		usr := &User{Username: "alice", Password: "hash"}
+		if err := store.CreateUser(usr); err != nil {
+			t.Fatalf("CreateUser: %s", err)
+		}
+		if usr.Id == 0 {
+			t.Errorf("CreateUser did not set the user id")
+		}
+		if err := store.CreateUser(&User{Username: "alice", Password: "other"}); err == nil {
+			t.Errorf("CreateUser allowed a duplicate username")
+		}
+		got, err := store.GetUser("alice")
+		if err != nil {
+			t.Fatalf("GetUser: %s", err)
+		}
+		if got.Id != usr.Id || got.Password != "hash" {
+			t.Errorf("GetUser = %+v, want id %d and stored password", got, usr.Id)
+		}
+		if _, err := store.GetUser("nobody"); err == nil {
+			t.Errorf("GetUser found a user that doesn't exist")
+		}
+		if err := store.CreateUser(&User{Username: "bob", Password: "hash"}); err != nil {
+			t.Fatalf("CreateUser: %s", err)
+		}
+		usrs, err := store.GetUsers()
+		if err != nil {
+			t.Fatalf("GetUsers: %s", err)
+		}
+		if len(usrs) != 2 {
+			t.Errorf("GetUsers returned %d users, want 2", len(usrs))
+		}
+		if got.Role != RoleUser {
+			t.Errorf("new users have role %q, want %q", got.Role, RoleUser)
+		}
+		if err := store.SetUserRole("alice", RoleModerator); err != nil {
+			t.Fatalf("SetUserRole: %s", err)
+		}
+		if got, _ := store.GetUser("alice"); got.Role != RoleModerator {
+			t.Errorf("SetUserRole didn't stick, role is %q", got.Role)
+		}
+		if err := store.SetUserRole("nobody", RoleModerator); err == nil {
+			t.Errorf("SetUserRole succeeded for a user that doesn't exist")
+		}
+	})
+
+	t.Run("EditAndDelete", func(t *testing.T) {
+		store := newStore(t)
+		msg := &templates.Message{Sender: "alice", Room: "lobby", Payload: "helo", Datetime: time.Now()}
+		if err := store.StoreMessage(msg); err != nil {
+			t.Fatalf("StoreMessage: %s", err)
+		}
+		if msg.Id == 0 {
+			t.Fatalf("StoreMessage did not set the message id")
+		}
+		if err := store.UpdateMessage(msg.Id, "hello"); err != nil {
+			t.Fatalf("UpdateMessage: %s", err)
+		}
+		got, err := store.GetMessage(msg.Id)
+		if err != nil {
+			t.Fatalf("GetMessage: %s", err)
+		}
+		if got.Payload != "hello" || !got.Edited || got.Sender != "alice" {
+			t.Errorf("after edit got %+v", got)
+		}
+		if err := store.DeleteMessage(msg.Id); err != nil {
+			t.Fatalf("DeleteMessage: %s", err)
+		}
+		got, _ = store.GetMessage(msg.Id)
+		if got.Payload != "" || !got.Deleted {
+			t.Errorf("after delete got %+v", got)
+		}
+		if err := store.UpdateMessage(msg.Id, "back from the dead"); err == nil {
+			t.Errorf("UpdateMessage edited a deleted message")
+		}
+		if _, err := store.GetMessage(msg.Id + 100); err == nil {
+			t.Errorf("GetMessage found a message that doesn't exist")
+		}
+	})
+
+	t.Run("BatchedMessages", func(t *testing.T) {
+		store := newStore(t)
+		ids, err := store.ReserveMessageIDs(3)
+		if err != nil || len(ids) != 3 {
+			t.Fatalf("ReserveMessageIDs = %v, %v", ids, err)
+		}
+		// A message stored directly must not take an id that was handed out for a batch.
+		direct := &templates.Message{Sender: "carol", Room: "lobby", Payload: "direct", Datetime: time.Now()}
+		if err := store.StoreMessage(direct); err != nil {
+			t.Fatalf("StoreMessage: %s", err)
+		}
+		if slices.Contains(ids, direct.Id) {
+			t.Fatalf("StoreMessage reused reserved id %d", direct.Id)
+		}
+		root := &templates.Message{Id: ids[0], Sender: "alice", Room: "lobby", Payload: "root", Datetime: time.Now()}
+		batch := []*templates.Message{
+			root,
+			{Id: ids[1], Sender: "bob", Room: "lobby", Payload: "reply", ParentId: root.Id, Datetime: time.Now()},
+			{Id: ids[2], Sender: "bob", Recipient: "alice", Payload: "psst", Datetime: time.Now()},
+		}
+		if err := store.StoreMessages(batch); err != nil {
+			t.Fatalf("StoreMessages: %s", err)
+		}
+		// Retrying a batch that was already stored is harmless.
+		if err := store.StoreMessages(batch); err != nil {
+			t.Fatalf("StoreMessages retry: %s", err)
+		}
+		for _, want := range batch {
+			got, err := store.GetMessage(want.Id)
+			if err != nil || got.Payload != want.Payload || got.ParentId != want.ParentId || got.Recipient != want.Recipient {
+				t.Errorf("GetMessage(%d) = %+v, %v, want %+v", want.Id, got, err, want)
+			}
+		}
+		if got, _ := store.GetMessage(root.Id); got.Replies != 1 {
+			t.Errorf("root has %d replies, want 1", got.Replies)
+		}
+		page, _ := store.GetMessages(&MessageQuery{Room: "lobby"})
+		if len(page) != 2 {
+			t.Errorf("GetMessages returned %d messages, want the root and the direct one", len(page))
+		}
+	})
+
+	t.Run("Reactions", func(t *testing.T) {
+		store := newStore(t)
+		msg := &templates.Message{Sender: "alice", Room: "lobby", Payload: "a", Datetime: time.Now()}
+		if err := store.StoreMessage(msg); err != nil {
+			t.Fatalf("StoreMessage: %s", err)
+		}
+		for _, r := range []struct{ user, emoji string }{{"bob", "🎉"}, {"alice", "👍"}, {"carol", "🎉"}} {
+			if added, err := store.ToggleReaction(msg.Id, r.user, r.emoji); err != nil || !added {
+				t.Fatalf("ToggleReaction(%s, %s) = %v, %v", r.user, r.emoji, added, err)
+			}
+		}
+		got, _ := store.GetMessage(msg.Id)
+		if len(got.Reactions) != 2 || got.Reactions[0].Emoji != "🎉" || len(got.Reactions[0].Users) != 2 {
+			t.Errorf("reactions = %+v, want 🎉 from bob and carol then 👍 from alice", got.Reactions)
+		}
+		if added, err := store.ToggleReaction(msg.Id, "bob", "🎉"); err != nil || added {
+			t.Errorf("toggling an existing reaction = %v, %v, want it removed", added, err)
+		}
+		page, _ := store.GetMessages(&MessageQuery{Room: "lobby"})
+		if len(page) != 1 || len(page[0].Reactions) != 2 || len(page[0].Reactions[0].Users) != 1 {
+			t.Errorf("GetMessages reactions = %+v", page[0].Reactions)
+		}
+		store.DeleteMessage(msg.Id)
+		if got, _ := store.GetMessage(msg.Id); len(got.Reactions) != 0 {
+			t.Errorf("deleted message kept its reactions: %+v", got.Reactions)
+		}
+	})
+
+	t.Run("Threads", func(t *testing.T) {
+		store := newStore(t)
+		root := &templates.Message{Sender: "alice", Room: "lobby", Payload: "a", Datetime: time.Now()}
+		if err := store.StoreMessage(root); err != nil {
+			t.Fatalf("StoreMessage: %s", err)
+		}
+		for _, payload := range []string{"b", "c"} {
+			reply := &templates.Message{Sender: "bob", Room: "lobby", Payload: payload, Datetime: time.Now(), ParentId: root.Id}
+			if err := store.StoreMessage(reply); err != nil {
+				t.Fatalf("StoreMessage reply: %s", err)
+			}
+		}
+		store.StoreMessage(&templates.Message{Sender: "bob", Room: "lobby", Payload: "d", Datetime: time.Now()})
+
+		thread, err := store.GetThread(root.Id)
+		if err != nil {
+			t.Fatalf("GetThread: %s", err)
+		}
+		assertPayloads(t, "thread", thread, "bc")
+		if thread[0].ParentId != root.Id {
+			t.Errorf("reply has parent %d, want %d", thread[0].ParentId, root.Id)
+		}
+		feed, _ := store.GetMessages(&MessageQuery{Room: "lobby"})
+		assertPayloads(t, "room feed", feed, "ad")
+		if feed[0].Replies != 2 || feed[1].Replies != 0 {
+			t.Errorf("reply counts are %d and %d, want 2 and 0", feed[0].Replies, feed[1].Replies)
+		}
+		if got, _ := store.GetMessage(root.Id); got.Replies != 2 {
+			t.Errorf("GetMessage reply count is %d, want 2", got.Replies)
+		}
+	})
+
+	t.Run("ReadMarkers", func(t *testing.T) {
+		store := newStore(t)
+		ids := []int{}
+		for _, m := range []struct{ sender, room, recipient string }{
+			{"alice", "lobby", ""},
+			{"bob", "lobby", ""},
+			{"bob", "", "alice"},
+			{"bob", "lobby", ""},
+			{"carol", "", "alice"},
+			{"alice", "games", ""},
+		} {
+			msg := &templates.Message{Sender: m.sender, Room: m.room, Recipient: m.recipient, Payload: "x", Datetime: time.Now()}
+			if err := store.StoreMessage(msg); err != nil {
+				t.Fatalf("StoreMessage: %s", err)
+			}
+			ids = append(ids, msg.Id)
+		}
+
+		if prev, err := store.MarkRead("alice", "lobby", ids[1]); err != nil || prev != 0 {
+			t.Fatalf("MarkRead = %d, %v, want 0, nil", prev, err)
+		}
+		if prev, _ := store.MarkRead("alice", "lobby", ids[0]); prev != ids[1] {
+			t.Errorf("MarkRead backwards returned %d, want %d", prev, ids[1])
+		}
+		store.MarkRead("alice", "@bob", ids[2])
+		store.MarkRead("bob", "lobby", ids[3])
+
+		counts, err := store.GetUnreadCounts("alice")
+		if err != nil {
+			t.Fatalf("GetUnreadCounts: %s", err)
+		}
+		want := map[string]int{"lobby": 1, "@bob": 0, "@carol": 1}
+		for conversation, n := range want {
+			if counts[conversation] != n {
+				t.Errorf("unread in %s = %d, want %d (all counts %v)", conversation, counts[conversation], n, counts)
+			}
+		}
+		if _, ok := counts["games"]; ok {
+			t.Errorf("counted a room alice never read: %v", counts)
+		}
+
+		markers, err := store.GetReadMarkers("lobby")
+		if err != nil {
+			t.Fatalf("GetReadMarkers: %s", err)
+		}
+		if len(markers) != 2 || markers["alice"] != ids[1] || markers["bob"] != ids[3] {
+			t.Errorf("lobby markers = %v", markers)
+		}
+	})
+
+	t.Run("RoomMessages", func(t *testing.T) {
+		store := newStore(t)
+		start := time.Now().UTC().Truncate(time.Second)
+		for i, m := range []struct{ sender, room, recipient string }{
+			{"alice", "lobby", ""},
+			{"bob", "lobby", ""},
+			{"alice", "games", ""},
+			{"alice", "", "bob"},
+			{"bob", "lobby", ""},
+			{"alice", "lobby", ""},
+		} {
+			err := store.StoreMessage(&templates.Message{
+				Sender:    m.sender,
+				Room:      m.room,
+				Recipient: m.recipient,
+				Payload:   string(rune('a' + i)),
+				Datetime:  start.Add(time.Duration(i) * time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("StoreMessage: %s", err)
+			}
+		}
+
+		lobby, err := store.GetMessages(&MessageQuery{Room: "lobby"})
+		if err != nil {
+			t.Fatalf("GetMessages: %s", err)
+		}
+		assertPayloads(t, "lobby", lobby, "abef")
+		for _, msg := range lobby {
+			if msg.Id == 0 {
+				t.Errorf("GetMessages returned a message without an id")
+			}
+		}
+
+		page, _ := store.GetMessages(&MessageQuery{Room: "lobby", Limit: 2})
+		assertPayloads(t, "newest page", page, "ef")
+		older, _ := store.GetMessages(&MessageQuery{Room: "lobby", Limit: 2, Before: page[0].Id})
+		assertPayloads(t, "older page", older, "ab")
+		newer, _ := store.GetMessages(&MessageQuery{Room: "lobby", Limit: 2, After: older[0].Id})
+		assertPayloads(t, "newer page", newer, "be")
+
+		bySender, _ := store.GetMessages(&MessageQuery{Sender: "alice"})
+		assertPayloads(t, "sender filter", bySender, "acf")
+
+		byTime, _ := store.GetMessages(&MessageQuery{
+			Room:  "lobby",
+			Since: start.Add(time.Minute),
+			Until: start.Add(5 * time.Minute),
+		})
+		assertPayloads(t, "time range", byTime, "be")
+	})
+
+	t.Run("DirectMessages", func(t *testing.T) {
+		store := newStore(t)
+		start := time.Now().UTC().Truncate(time.Second)
+		for i, m := range []struct{ sender, recipient string }{
+			{"alice", "bob"},
+			{"bob", "alice"},
+			{"carol", "alice"},
+			{"alice", "bob"},
+			{"bob", "carol"},
+		} {
+			err := store.StoreMessage(&templates.Message{
+				Sender:    m.sender,
+				Recipient: m.recipient,
+				Payload:   string(rune('a' + i)),
+				Datetime:  start.Add(time.Duration(i) * time.Minute),
+			})
+			if err != nil {
+				t.Fatalf("StoreMessage: %s", err)
+			}
+		}
+
+		conv, err := store.GetConversation("bob", "alice")
+		if err != nil {
+			t.Fatalf("GetConversation: %s", err)
+		}
+		assertPayloads(t, "conversation", conv, "abd")
+
+		between := [2]string{"alice", "bob"}
+		latest, _ := store.GetMessages(&MessageQuery{Between: between, Limit: 1})
+		assertPayloads(t, "latest direct message", latest, "d")
+		after, _ := store.GetMessages(&MessageQuery{Between: between, After: conv[0].Id, Limit: 1})
+		assertPayloads(t, "direct messages after a cursor", after, "b")
+		before, _ := store.GetMessages(&MessageQuery{Between: between, Before: conv[2].Id})
+		assertPayloads(t, "direct messages before a cursor", before, "ab")
+
+		inbox, err := store.GetInbox("alice")
+		if err != nil {
+			t.Fatalf("GetInbox: %s", err)
+		}
+		assertPayloads(t, "inbox", inbox, "dc")
+
+		rooms, _ := store.GetMessages(&MessageQuery{})
+		assertPayloads(t, "room history", rooms, "")
+	})
+}
+
+// assertPayloads checks the messages' payloads, one letter each, spell want.
+func assertPayloads(t *testing.T, name string, messages []*templates.Message, want string) {
+	t.Helper()
+	got := ""
+	for _, msg := range messages {
+		got += msg.Payload
+	}
+	if got != want {
+		t.Errorf("%s: got payloads %q, want %q", name, got, want)
+	}
+}
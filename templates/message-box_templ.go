@@ -58,7 +58,7 @@ func WsMessageBox() templ.Component {
 			templ_7745c5c3_Var2 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 2, "<form ws-send class=\"w-full mt-6 flex flex-row gap-3\" hx-reset-on-success><input class=\"w-full border rounded-md p-3\" id=\"sender\" name=\"sender\" type=\"text\" placeholder=\"Enter your name\"> <input class=\"w-full border rounded-md p-6\" id=\"payload\" name=\"payload\" type=\"text\" placeholder=\"Enter a message\"> <button type=\"submit\" class=\"rounded-md p-3 text-white bg-black\">Send WS</button></form>")
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 2, "<form ws-send class=\"w-full mt-6 flex flex-row gap-3\" hx-reset-on-success><input class=\"w-full border rounded-md p-6\" id=\"payload\" name=\"payload\" type=\"text\" placeholder=\"Enter a message\" ws-send hx-trigger=\"input[this.value != &#39;&#39;] throttle:2s\" hx-vals=\"{&#34;action&#34;: &#34;typing&#34;}\"> <button type=\"submit\" class=\"rounded-md p-3 text-white bg-black\">Send WS</button></form>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
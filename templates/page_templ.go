@@ -92,14 +92,14 @@ func WsPage(title string) templ.Component {
 			templ_7745c5c3_Var4 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 5, "<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1\"><script src=\"https://unpkg.com/htmx.org@2.0.4\" integrity=\"sha384-HGfztofotfshcF7+8n44JQL2oJmowVChPTg48S+jvZoztPfvwD79OC/LTtG6dMp+\" crossorigin=\"anonymous\"></script><script src=\"https://unpkg.com/htmx.org@1.9.12/dist/ext/ws.js\"></script><link rel=\"stylesheet\" href=\"/assets/styles.css\"><title>")
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 5, "<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1\"><script src=\"https://unpkg.com/htmx.org@2.0.4\" integrity=\"sha384-HGfztofotfshcF7+8n44JQL2oJmowVChPTg48S+jvZoztPfvwD79OC/LTtG6dMp+\" crossorigin=\"anonymous\"></script><script src=\"https://unpkg.com/htmx.org@1.9.12/dist/ext/ws.js\"></script><script>\n\t\t\t\t// Every (re)connect tells the server the newest message on the page,\n\t\t\t\t// so it can replay anything sent while the socket was down.\n\t\t\t\t(function () {\n\t\t\t\t\tvar connect = htmx.createWebSocket;\n\t\t\t\t\thtmx.createWebSocket = function (url) {\n\t\t\t\t\t\tvar since = 0;\n\t\t\t\t\t\tdocument.querySelectorAll(\"#feed [id^='msg-']\").forEach(function (el) {\n\t\t\t\t\t\t\tsince = Math.max(since, parseInt(el.id.slice(4), 10) || 0);\n\t\t\t\t\t\t});\n\t\t\t\t\t\tif (since > 0) {\n\t\t\t\t\t\t\turl += (url.indexOf(\"?\") < 0 ? \"?\" : \"&\") + \"since=\" + since;\n\t\t\t\t\t\t}\n\t\t\t\t\t\treturn connect(url);\n\t\t\t\t\t};\n\t\t\t\t})();\n\n\t\t\t\t// markSeen notes that message id came into view, for the read\n\t\t\t\t// tracker to mark read once messages stop arriving.\n\t\t\t\tvar latestSeen = 0;\n\t\t\t\tfunction markSeen(id) {\n\t\t\t\t\tif (document.visibilityState != \"visible\") {\n\t\t\t\t\t\treturn;\n\t\t\t\t\t}\n\t\t\t\t\tlatestSeen = Math.max(latestSeen, id);\n\t\t\t\t\thtmx.trigger(\"#read-seen\", \"seen\");\n\t\t\t\t}\n\t\t\t</script><link rel=\"stylesheet\" href=\"/assets/styles.css\"><title>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
 		var templ_7745c5c3_Var5 string
 		templ_7745c5c3_Var5, templ_7745c5c3_Err = templ.JoinStringErrs(title)
 		if templ_7745c5c3_Err != nil {
-			return templ.Error{Err: templ_7745c5c3_Err, FileName: `templates/page.templ`, Line: 31, Col: 17}
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `templates/page.templ`, Line: 59, Col: 17}
 		}
 		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var5))
 		if templ_7745c5c3_Err != nil {
@@ -112,7 +112,7 @@ func WsPage(title string) templ.Component {
 		var templ_7745c5c3_Var6 string
 		templ_7745c5c3_Var6, templ_7745c5c3_Err = templ.JoinStringErrs(title)
 		if templ_7745c5c3_Err != nil {
-			return templ.Error{Err: templ_7745c5c3_Err, FileName: `templates/page.templ`, Line: 35, Col: 75}
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `templates/page.templ`, Line: 63, Col: 75}
 		}
 		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var6))
 		if templ_7745c5c3_Err != nil {
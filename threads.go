@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// threadRoot looks up the message idStr names, for replying to or opening the
+// thread of. Threads are one level deep, so a reply's thread is its parent's.
+func (c *Client) threadRoot(idStr string) (*templates.Message, error) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a message id.", idStr)
+	}
+	root, err := c.manager.store.GetMessage(id)
+	if err == nil && root.ParentId != 0 {
+		root, err = c.manager.store.GetMessage(root.ParentId)
+	}
+	if err != nil || !c.canSee(root) {
+		return nil, fmt.Errorf("That message doesn't exist.")
+	}
+	if root.Recipient != "" || c.peer != "" {
+		return nil, fmt.Errorf("Threads are only for room messages.")
+	}
+	if root.Deleted {
+		return nil, fmt.Errorf("That message was deleted.")
+	}
+	return root, nil
+}
+
+// inThread makes msg a reply in the thread of the message parentStr names.
+func (c *Client) inThread(msg *templates.Message, parentStr string) error {
+	root, err := c.threadRoot(parentStr)
+	if err != nil {
+		return err
+	}
+	msg.ParentId = root.Id
+	msg.Room = root.Room
+	return nil
+}
+
+// openThread opens the thread of the message idStr names in the client's
+// thread pane, or closes the pane when idStr is empty.
+func (c *Client) openThread(idStr string) error {
+	if idStr == "" {
+		f := newFrame(templates.WsThreadClosed(), protocol.TypeThread, &templates.Message{Room: c.room, Datetime: time.Now()})
+		f.envelope.ID = ""
+		c.manager.do(func() {
+			if _, ok := c.manager.clients[c]; ok {
+				c.thread = 0
+				c.manager.deliver(c, f)
+			}
+		})
+		return nil
+	}
+	root, err := c.threadRoot(idStr)
+	if err != nil {
+		return err
+	}
+	// Replies delivered while the rest load are caught up with as the thread
+	// opens, so none are missed in between.
+	seen := c.manager.delivered.Load()
+	replies, err := c.manager.thread(root.Id)
+	if err != nil {
+		c.manager.logger.Printf("get thread error: %s", err)
+	}
+	c.manager.do(func() {
+		if _, ok := c.manager.clients[c]; !ok {
+			return
+		}
+		replies, complete := c.manager.catchUp(replies, seen, func(msg *templates.Message) bool {
+			return msg.ParentId == root.Id
+		})
+		if !complete {
+			c.manager.logger.Printf("thread %d opened without some replies sent while it loaded", root.Id)
+		}
+		root.Replies = len(replies)
+		c.thread = root.Id
+		c.manager.deliver(c, newFrame(templates.WsThread(root, replies), protocol.TypeThread, root))
+	})
+	return nil
+}
+
+// thread returns the replies to the message parentID, oldest first, including
+// those still waiting to be stored.
+func (manager *ClientManager) thread(parentID int) ([]*templates.Message, error) {
+	return manager.persist.withUnstored(func() ([]*templates.Message, error) {
+		return manager.store.GetThread(parentID)
+	}, func(msg *templates.Message) bool {
+		return msg.ParentId == parentID
+	})
+}
+
+// stored shares a newly stored batch with the other servers and updates the
+// reply counts of threads that got replies in it. Both wait for the messages to
+// be in the database: other servers look messages up there as soon as they
+// hear of them, and the counts come from it. It runs on the persister goroutine.
+func (manager *ClientManager) stored(batch []*templates.Message) {
+	for _, msg := range batch {
+		manager.publish(&Event{Kind: EventMessage, Message: msg})
+		if parentID := msg.ParentId; parentID != 0 {
+			go manager.updateReplyCount(parentID)
+			manager.publish(&Event{Kind: EventReplies, ID: parentID})
+		}
+	}
+}
+
+// updateReplyCount tells the room the parent message's reply count changed.
+// It looks the count up on the caller's goroutine, which must not be the
+// manager's, and routes it on the manager's.
+func (manager *ClientManager) updateReplyCount(parentID int) {
+	parent, err := manager.store.GetMessage(parentID)
+	if err != nil {
+		manager.logger.Printf("error counting replies: %s", err)
+		return
+	}
+	f := newFrame(templates.WsReplyCount(parent), protocol.TypeThread, parent)
+	f.key = "replies:" + strconv.Itoa(parentID)
+	manager.later(func() { manager.route(parent, f) })
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/muhreeowki/mchat/protocol"
+	"github.com/muhreeowki/mchat/templates"
+)
+
+// typingTimeout is how long a typing indicator lasts without another typing
+// event. Browsers send one at most every couple of seconds while typing.
+const typingTimeout = 5 * time.Second
+
+// typingInterval is how often the manager clears expired typing indicators.
+const typingInterval = time.Second
+
+// startTyping marks client's user as typing in its room. Typing events are
+// ephemeral: they are never stored, and only a user starting to type is
+// announced; repeats just push back the expiry.
+func (manager *ClientManager) startTyping(client *Client) {
+	room := manager.clients[client]
+	if room == nil {
+		return
+	}
+	manager.setTyping(room, client.username)
+	manager.publish(&Event{Kind: EventTyping, Room: room.name, Username: client.username, Typing: true})
+}
+
+// setTyping marks username as typing in room for the next typingTimeout.
+func (manager *ClientManager) setTyping(room *Room, username string) {
+	typists, ok := manager.typists[room]
+	if !ok {
+		typists = make(map[string]time.Time)
+		manager.typists[room] = typists
+	}
+	_, already := typists[username]
+	typists[username] = time.Now().Add(typingTimeout)
+	if !already {
+		manager.publishTyping(room)
+	}
+}
+
+// stopTyping clears username's typing indicator in room, if it has one.
+func (manager *ClientManager) stopTyping(room *Room, username string) {
+	typists := manager.typists[room]
+	if _, ok := typists[username]; !ok {
+		return
+	}
+	delete(typists, username)
+	if len(typists) == 0 {
+		delete(manager.typists, room)
+	}
+	manager.publishTyping(room)
+}
+
+// expireTyping clears the indicators of everyone who stopped typing.
+func (manager *ClientManager) expireTyping(now time.Time) {
+	for room, typists := range manager.typists {
+		changed := false
+		for username, expiry := range typists {
+			if now.After(expiry) {
+				delete(typists, username)
+				changed = true
+			}
+		}
+		if len(typists) == 0 {
+			delete(manager.typists, room)
+		}
+		if changed {
+			manager.publishTyping(room)
+		}
+	}
+}
+
+// publishTyping tells everyone in room who else is typing there.
+func (manager *ClientManager) publishTyping(room *Room) {
+	typing := []string{}
+	for username := range manager.typists[room] {
+		typing = append(typing, username)
+	}
+	slices.Sort(typing)
+	// People don't need to be told they are typing, so each user gets their own frame.
+	frames := make(map[string]*frame)
+	for client := range room.clients {
+		f, ok := frames[client.username]
+		if !ok {
+			others := slices.DeleteFunc(slices.Clone(typing), func(u string) bool { return u == client.username })
+			f = newFrame(templates.WsTyping(others), protocol.TypeTyping, &templates.Message{Room: room.name, Datetime: time.Now()})
+			f.envelope.ID = ""
+			f.key = "typing:" + room.name
+			for _, u := range others {
+				f.envelope.Users = append(f.envelope.Users, protocol.Presence{Username: u, Status: protocol.StatusTyping})
+			}
+			frames[client.username] = f
+		}
+		manager.deliver(client, f)
+	}
+}